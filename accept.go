@@ -0,0 +1,67 @@
+package falcore
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+// Accept errors are retried after a delay that doubles from
+// acceptBackoffMin up to acceptBackoffMax
+const (
+	acceptBackoffMin = 5 * time.Millisecond
+	acceptBackoffMax = time.Second
+)
+
+// The deadline set so the accept loop can check whether it's stopping
+func isAcceptTimeout(err error) bool {
+	ope, ok := err.(*net.OpError)
+	return ok && ope.Timeout() && ope.Temporary()
+}
+
+// Out of file descriptors, for the process or the whole system
+func isFdExhausted(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+}
+
+func isTemporaryAcceptError(err error) bool {
+	if isFdExhausted(err) {
+		return true
+	}
+	te, ok := err.(interface{ Temporary() bool })
+	return ok && te.Temporary()
+}
+
+// Counts and reports an accept error and waits before the next Accept.
+// Returns the delay to use if the next one fails too.  Running out of file
+// descriptors closes idle keep-alive connections to free some up.
+func (srv *Server) acceptError(l net.Listener, err error, delay time.Duration) time.Duration {
+	srv.stats.acceptErrors.Add(1)
+	if srv.AcceptErrorCallback != nil {
+		srv.AcceptErrorCallback(l, err)
+	}
+	if delay == 0 {
+		delay = acceptBackoffMin
+	} else if delay *= 2; delay > acceptBackoffMax {
+		delay = acceptBackoffMax
+	}
+	if isFdExhausted(err) {
+		closed := srv.closeConns(true)
+		srv.stats.fdExhaustedCloses.Add(uint64(closed))
+		Error("%s SERVER Accept Error: %v.  Closed %d idle connections, retrying in %v", srv.serverLogPrefix(), err, closed, delay)
+	} else if isTemporaryAcceptError(err) {
+		Warn("%s SERVER Accept Error: %v.  Retrying in %v", srv.serverLogPrefix(), err, delay)
+	} else {
+		// not much point retrying quickly either
+		delay = acceptBackoffMax
+		Error("%s SERVER Accept Error: %v", srv.serverLogPrefix(), err)
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-srv.stopAccepting:
+	}
+	return delay
+}
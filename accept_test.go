@@ -0,0 +1,84 @@
+package falcore
+
+import (
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Fails every Accept with err until the Server stops
+type failingListener struct {
+	net.Listener
+	srv *Server
+	err error
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	if l.srv.stopping() {
+		return nil, net.ErrClosed
+	}
+	return nil, l.err
+}
+
+func TestAcceptErrorBackoff(t *testing.T) {
+	srv := NewServer(0, NewPipeline())
+	var mutex sync.Mutex
+	var times []time.Time
+	srv.AcceptErrorCallback = func(l net.Listener, err error) {
+		mutex.Lock()
+		times = append(times, time.Now())
+		mutex.Unlock()
+	}
+	err := &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	l := &failingListener{srv: srv, err: err}
+
+	// an idle keep-alive connection gets closed to free up a descriptor
+	idle, client := net.Pipe()
+	defer client.Close()
+	srv.trackConn(idle)
+	srv.setConnState(idle, ConnIdle)
+
+	done := make(chan int)
+	go func() {
+		srv.acceptLoop(l)
+		close(done)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	srv.StopAccepting()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected the accept loop to stop while backing off")
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	// 5 + 10 + 20 + 40 + 80ms fits in 200ms, a hot loop would be far more
+	if len(times) < 3 || len(times) > 7 {
+		t.Errorf("Expected the retries to back off: %v errors", len(times))
+	}
+	for i := 2; i < len(times); i++ {
+		if times[i].Sub(times[i-1]) < times[i-1].Sub(times[i-2]) {
+			t.Errorf("Expected the delay to grow: %v", times)
+		}
+	}
+	stats := srv.Stats()
+	if stats.AcceptErrors != uint64(len(times)) || stats.FdExhaustedCloses != 1 {
+		t.Errorf("Expected the errors and the closed connection to be counted: %+v", stats)
+	}
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Errorf("Expected the idle connection to be closed")
+	}
+}
+
+func TestIsTemporaryAcceptError(t *testing.T) {
+	if !isTemporaryAcceptError(os.NewSyscallError("accept", syscall.ENFILE)) {
+		t.Errorf("Expected ENFILE to be temporary")
+	}
+	if isTemporaryAcceptError(net.ErrClosed) {
+		t.Errorf("Expected a closed listener not to be temporary")
+	}
+}
@@ -20,11 +20,39 @@ type bufferPool struct {
 type bufferPoolEntry struct {
 	br     *bufio.Reader
 	source io.Reader
+	// bytes left before reads return EOF, or noReadLimit
+	limit   int64
+	limited bool
 }
 
+const noReadLimit = -1
+
 // make bufferPoolEntry a passthrough io.Reader
 func (bpe *bufferPoolEntry) Read(p []byte) (n int, err error) {
-	return bpe.source.Read(p)
+	if bpe.limit == noReadLimit {
+		return bpe.source.Read(p)
+	}
+	if bpe.limit <= 0 {
+		bpe.limited = true
+		return 0, io.EOF
+	}
+	if int64(len(p)) > bpe.limit {
+		p = p[:bpe.limit]
+	}
+	n, err = bpe.source.Read(p)
+	bpe.limit -= int64(n)
+	return
+}
+
+// Caps the number of bytes read from the source from now on
+func (bpe *bufferPoolEntry) setReadLimit(n int64) {
+	bpe.limit = n
+	bpe.limited = false
+}
+
+// Whether a read was cut off by the limit
+func (bpe *bufferPoolEntry) limitReached() bool {
+	return bpe.limited
 }
 
 func newBufferPool(poolSize, bufferSize int) *bufferPool {
@@ -46,9 +74,10 @@ func (p *bufferPool) take(r io.Reader) (bpe *bufferPoolEntry) {
 		}
 		// swap out the underlying reader
 		bpe.source = r
+		bpe.setReadLimit(noReadLimit)
 	default:
 		// none available.  create a new one
-		bpe = &bufferPoolEntry{nil, r}
+		bpe = &bufferPoolEntry{source: r, limit: noReadLimit}
 		bpe.br = bufio.NewReaderSize(bpe, p.bufSize)
 	}
 	return
@@ -58,3 +58,21 @@ func TestBufferPool(t *testing.T) {
 	pool.give(bpe)
 
 }
+
+func TestBufferPoolReadLimit(t *testing.T) {
+	pool := newBufferPool(10, 1024)
+	bpe := pool.take(bytes.NewBufferString("Hello World"))
+	bpe.setReadLimit(5)
+	out := make([]byte, 1024)
+	if l, _ := bpe.br.Read(out); string(out[:l]) != "Hello" {
+		t.Errorf("Expected the read to stop at the limit: %q", out[:l])
+	}
+	if _, err := bpe.br.Read(out); err == nil || !bpe.limitReached() {
+		t.Errorf("Expected the limit to be reached: %v", err)
+	}
+	bpe.setReadLimit(noReadLimit)
+	if l, _ := bpe.br.Read(out); string(out[:l]) != " World" || bpe.limitReached() {
+		t.Errorf("Expected the rest once the limit was lifted: %q", out[:l])
+	}
+	pool.give(bpe)
+}
@@ -0,0 +1,115 @@
+package falcore
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Why a request was cancelled.  See Request.Err.
+var (
+	ErrClientDisconnected = errors.New("client disconnected")
+	ErrServerShutdown     = errors.New("server shutdown deadline passed")
+	ErrRequestTimeout     = errors.New("request exceeded WriteTimeout")
+)
+
+// Gives the request a context that's cancelled when the Server is killed
+// or WriteTimeout passes.  The returned cancel must be called once the
+// response is written.
+func (srv *Server) requestContext(req *http.Request) (*http.Request, context.CancelCauseFunc) {
+	ctx, cancel := context.WithCancelCause(req.Context())
+	stopTimer := context.CancelFunc(func() {})
+	if srv.WriteTimeout > 0 {
+		ctx, stopTimer = context.WithTimeoutCause(ctx, srv.WriteTimeout, ErrRequestTimeout)
+	}
+	stop := context.AfterFunc(srv.ctx, func() {
+		cancel(ErrServerShutdown)
+	})
+	return req.WithContext(ctx), func(cause error) {
+		stop()
+		stopTimer()
+		cancel(cause)
+	}
+}
+
+// Watches for the client closing the connection while the pipeline runs.
+// It can only start once the request body has been read, otherwise it
+// would steal the body from the pipeline.
+type disconnectWatcher struct {
+	srv     *Server
+	c       net.Conn
+	br      *bufio.Reader
+	cancel  context.CancelCauseFunc
+	mutex   sync.Mutex
+	started bool
+	stopped bool
+	aborted bool
+	done    chan int
+}
+
+func (srv *Server) newDisconnectWatcher(c net.Conn, br *bufio.Reader, cancel context.CancelCauseFunc) *disconnectWatcher {
+	return &disconnectWatcher{srv: srv, c: c, br: br, cancel: cancel, done: make(chan int)}
+}
+
+func (w *disconnectWatcher) start() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.started || w.stopped {
+		return
+	}
+	w.started = true
+	// the body is done so ReadTimeout doesn't matter any more
+	w.c.SetReadDeadline(time.Time{})
+	go func() {
+		defer close(w.done)
+		// anything that arrives is the next request and stays buffered
+		_, err := w.br.Peek(1)
+		w.mutex.Lock()
+		aborted := w.aborted
+		w.mutex.Unlock()
+		if err != nil && !aborted {
+			if w.srv.ctx.Err() != nil {
+				// Shutdown killed the connection
+				w.cancel(ErrServerShutdown)
+			} else {
+				w.cancel(ErrClientDisconnected)
+			}
+		}
+	}()
+}
+
+// Stops watching before the response is written
+func (w *disconnectWatcher) stop() {
+	w.mutex.Lock()
+	w.stopped = true
+	started := w.started
+	if started {
+		w.aborted = true
+		// unblocks Peek
+		w.c.SetReadDeadline(time.Unix(1, 0))
+	}
+	w.mutex.Unlock()
+	if started {
+		<-w.done
+		w.c.SetReadDeadline(time.Time{})
+	}
+}
+
+// Starts the watcher when the body has been read to the end
+type eofSignalBody struct {
+	io.ReadCloser
+	onEOF func()
+}
+
+func (b *eofSignalBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.onEOF()
+	}
+	return n, err
+}
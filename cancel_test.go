@@ -0,0 +1,161 @@
+package falcore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Blocks until the request is cancelled and reports why
+func newCancelTestServer(t *testing.T) (*Server, chan int, chan error) {
+	started := make(chan int, 1)
+	cause := make(chan error, 1)
+	srv := newTestServer(t, func(req *Request) *http.Response {
+		started <- 1
+		select {
+		case <-req.Done():
+			cause <- req.Err()
+		case <-time.After(5 * time.Second):
+			cause <- nil
+		}
+		return SimpleResponse(req.HttpRequest, 200, nil, "done")
+	})
+	return srv, started, cause
+}
+
+func TestRequestCancelDisconnect(t *testing.T) {
+	// a ReadTimeout wraps the body so that mustn't hide that there isn't one
+	for _, timeout := range []time.Duration{0, 10 * time.Second} {
+		srv, started, cause := newCancelTestServer(t)
+		srv.ReadTimeout = timeout
+		startTestServer(srv)
+
+		c, _ := dialTestServer(t, srv)
+		io.WriteString(c, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+		<-started
+		c.Close()
+		if err := <-cause; err != ErrClientDisconnected {
+			t.Errorf("ReadTimeout %v: Expected ErrClientDisconnected got %v", timeout, err)
+		}
+		srv.Shutdown(time.Now().Add(time.Second))
+	}
+}
+
+func TestRequestCancelBody(t *testing.T) {
+	srv, started, cause := newCancelTestServer(t)
+	startTestServer(srv)
+	defer srv.Shutdown(time.Now().Add(time.Second))
+
+	// the filter hasn't read the body so the disconnect isn't noticed
+	// until the request finishes
+	c, _ := dialTestServer(t, srv)
+	io.WriteString(c, "POST / HTTP/1.1\r\nHost: test\r\nContent-Length: 5\r\n\r\nhello")
+	<-started
+	c.Close()
+	select {
+	case err := <-cause:
+		t.Errorf("Request cancelled before the body was read: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestRequestCancelTimeout(t *testing.T) {
+	srv, started, cause := newCancelTestServer(t)
+	srv.WriteTimeout = 100 * time.Millisecond
+	startTestServer(srv)
+	defer srv.Shutdown(time.Now().Add(time.Second))
+
+	c, _ := dialTestServer(t, srv)
+	defer c.Close()
+	io.WriteString(c, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+	<-started
+	if err := <-cause; err != ErrRequestTimeout {
+		t.Errorf("Expected ErrRequestTimeout got %v", err)
+	}
+}
+
+func TestRequestCancelShutdown(t *testing.T) {
+	srv, started, cause := newCancelTestServer(t)
+	startTestServer(srv)
+
+	c, _ := dialTestServer(t, srv)
+	defer c.Close()
+	io.WriteString(c, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+	<-started
+	srv.Shutdown(time.Now().Add(100 * time.Millisecond))
+	if err := <-cause; err != ErrServerShutdown {
+		t.Errorf("Expected ErrServerShutdown got %v", err)
+	}
+}
+
+func TestRequestCancelPipelined(t *testing.T) {
+	srv := newTestServer(t, func(req *Request) *http.Response {
+		time.Sleep(50 * time.Millisecond)
+		return SimpleResponse(req.HttpRequest, 200, nil, fmt.Sprint(req.Err()))
+	})
+	startTestServer(srv)
+	defer srv.Shutdown(time.Now().Add(time.Second))
+
+	// the second request arriving early isn't a disconnect
+	c, br := dialTestServer(t, srv)
+	defer c.Close()
+	req := "GET / HTTP/1.1\r\nHost: test\r\n\r\n"
+	if _, body := roundTrip(t, c, br, req+req); body != "<nil>" {
+		t.Errorf("First request was cancelled: %v", body)
+	}
+	if _, body := roundTrip(t, c, br, ""); body != "<nil>" {
+		t.Errorf("Second request was cancelled: %v", body)
+	}
+}
+
+func TestHandlerFilterCancel(t *testing.T) {
+	started := make(chan int, 1)
+	cause := make(chan error, 1)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- 1
+		select {
+		case <-r.Context().Done():
+			cause <- context.Cause(r.Context())
+		case <-time.After(5 * time.Second):
+			cause <- nil
+		}
+	})
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(NewHandlerFilter(handler))
+	srv := NewServer(0, pipeline)
+	if err := srv.socketListen(); err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	startTestServer(srv)
+	defer srv.Shutdown(time.Now().Add(time.Second))
+
+	c, _ := dialTestServer(t, srv)
+	io.WriteString(c, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+	<-started
+	c.Close()
+	if err := <-cause; err != ErrClientDisconnected {
+		t.Errorf("Expected ErrClientDisconnected got %v", err)
+	}
+}
+
+func TestHandlerFilterCancelStage(t *testing.T) {
+	release := make(chan int)
+	defer close(release)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(ErrClientDisconnected)
+	tmp, _ := http.NewRequestWithContext(ctx, "GET", "/", nil)
+	req, res := TestWithRequest(tmp, NewHandlerFilter(handler), nil)
+	if res.StatusCode != 503 {
+		t.Errorf("Expected 503 got %v", res.StatusCode)
+	}
+	// the same as the upstream filter reports it
+	if req.CurrentStage.Status != StatusSkip || req.CurrentStage.Err != ErrClientDisconnected {
+		t.Errorf("Expected the cancellation on a skipped stage got %v %v", req.CurrentStage.Status, req.CurrentStage.Err)
+	}
+}
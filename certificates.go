@@ -0,0 +1,298 @@
+package falcore
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A set of TLS certificates chosen by SNI server name.  Certificates can
+// be loaded from individual files or from directories and reloaded at any
+// time without restarting the Server.  A failed reload leaves the
+// previously loaded certificates in place.
+//
+// In a directory, every *.crt and *.pem file is loaded with the key from
+// the matching *.key file.  A .pem with no .key is loaded if it contains
+// both the certificate and the key.  Anything else without a key, like a
+// chain.pem, is skipped.
+//
+// Set Server.TLSCertificates to use a store with ListenAndServeTLS.
+//
+//	certs := falcore.NewCertificateStore()
+//	if err := certs.AddDir("/etc/ssl/falcore"); err != nil {
+//	    // bad certs
+//	}
+//	go certs.ReloadOnSignal(syscall.SIGHUP)
+//	srv.TLSCertificates = certs
+//	srv.ListenAndServeTLS("", "")
+type CertificateStore struct {
+	// Used when the client doesn't send SNI or nothing matches.  Defaults
+	// to the first certificate loaded.
+	DefaultName string
+
+	// held through a whole reload so adds don't race each other
+	reloadMutex sync.Mutex
+	mutex       sync.RWMutex
+	files       [][2]string
+	dirs        []string
+	certs       []*tls.Certificate
+	byName      map[string]*tls.Certificate
+	modTime     map[string]time.Time
+}
+
+func NewCertificateStore() *CertificateStore {
+	cs := new(CertificateStore)
+	cs.byName = make(map[string]*tls.Certificate)
+	cs.modTime = make(map[string]time.Time)
+	return cs
+}
+
+// Adds a certificate/key pair.  The files are read again on every Reload.
+// If they can't be loaded the pair isn't added.
+func (cs *CertificateStore) AddFile(certFile, keyFile string) error {
+	return cs.reload([2]string{certFile, keyFile}, "")
+}
+
+// Adds every certificate in dir.  The directory is scanned again on every
+// Reload so new certificates are picked up.  If it can't be loaded the
+// directory isn't added.
+func (cs *CertificateStore) AddDir(dir string) error {
+	return cs.reload([2]string{}, dir)
+}
+
+// Reads all the files and directories again and swaps in the new
+// certificates.  On error nothing changes.
+func (cs *CertificateStore) Reload() error {
+	return cs.reload([2]string{}, "")
+}
+
+// Reloads with addFile or addDir added, if they're set.  They're only kept
+// if everything loads.
+func (cs *CertificateStore) reload(addFile [2]string, addDir string) error {
+	cs.reloadMutex.Lock()
+	defer cs.reloadMutex.Unlock()
+	cs.mutex.RLock()
+	files := append([][2]string{}, cs.files...)
+	dirs := append([]string{}, cs.dirs...)
+	cs.mutex.RUnlock()
+	if addFile[0] != "" {
+		files = append(files, addFile)
+	}
+	if addDir != "" {
+		dirs = append(dirs, addDir)
+	}
+
+	pairs := append([][2]string{}, files...)
+	for _, dir := range dirs {
+		dirPairs, skipped, err := certificateDirFiles(dir)
+		if err != nil {
+			return err
+		}
+		for _, f := range skipped {
+			Warn("Skipping TLS certificate %v, there's no key for it", f)
+		}
+		pairs = append(pairs, dirPairs...)
+	}
+
+	var certs []*tls.Certificate
+	byName := make(map[string]*tls.Certificate)
+	modTime := make(map[string]time.Time)
+	for _, pair := range pairs {
+		cert, err := loadCertificate(pair[0], pair[1])
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+		for _, name := range certificateNames(cert.Leaf) {
+			if _, ok := byName[name]; !ok {
+				byName[name] = cert
+			}
+		}
+		for _, f := range pair {
+			if fi, err := os.Stat(f); err == nil {
+				modTime[f] = fi.ModTime()
+			}
+		}
+	}
+	for _, dir := range dirs {
+		if fi, err := os.Stat(dir); err == nil {
+			modTime[dir] = fi.ModTime()
+		}
+	}
+
+	cs.mutex.Lock()
+	cs.files, cs.dirs = files, dirs
+	cs.certs, cs.byName, cs.modTime = certs, byName, modTime
+	cs.mutex.Unlock()
+	Debug("Loaded %v TLS certificates", len(certs))
+	return nil
+}
+
+// Picks a certificate for the client's SNI server name.  Exact matches
+// win over wildcards.  Use as tls.Config.GetCertificate.
+func (cs *CertificateStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cs.mutex.RLock()
+	defer cs.mutex.RUnlock()
+	name := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+	if cert, ok := cs.byName[name]; ok {
+		return cert, nil
+	}
+	if i := strings.Index(name, "."); i > 0 {
+		if cert, ok := cs.byName["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+	if cert, ok := cs.byName[strings.ToLower(cs.DefaultName)]; ok {
+		return cert, nil
+	}
+	if len(cs.certs) > 0 {
+		return cs.certs[0], nil
+	}
+	return nil, errors.New("No TLS certificates loaded")
+}
+
+// Calls Reload every time one of the signals is received.  Blocks forever.
+func (cs *CertificateStore) ReloadOnSignal(sig ...os.Signal) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, sig...)
+	for s := range sigChan {
+		Info("Received %v.  Reloading TLS certificates.", s)
+		if err := cs.Reload(); err != nil {
+			Error("Reloading TLS certificates failed: %v", err)
+		}
+	}
+}
+
+// Checks the files and directories for changes every interval and reloads
+// when something changed.  Blocks until quit is closed.
+func (cs *CertificateStore) Watch(interval time.Duration, quit <-chan int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+		if !cs.changed() {
+			continue
+		}
+		Info("TLS certificates changed.  Reloading.")
+		if err := cs.Reload(); err != nil {
+			Error("Reloading TLS certificates failed: %v", err)
+		}
+	}
+}
+
+func (cs *CertificateStore) changed() bool {
+	cs.mutex.RLock()
+	defer cs.mutex.RUnlock()
+	for _, pair := range cs.files {
+		for _, f := range pair {
+			if fileChanged(f, cs.modTime) {
+				return true
+			}
+		}
+	}
+	for _, dir := range cs.dirs {
+		if fileChanged(dir, cs.modTime) {
+			return true
+		}
+		pairs, _, _ := certificateDirFiles(dir)
+		for _, pair := range pairs {
+			for _, f := range pair {
+				if fileChanged(f, cs.modTime) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func fileChanged(name string, modTime map[string]time.Time) bool {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return false
+	}
+	last, ok := modTime[name]
+	return !ok || !fi.ModTime().Equal(last)
+}
+
+// Finds the certificate/key pairs in a directory, and the certificates
+// that were skipped because there's no key for them
+func certificateDirFiles(dir string) (pairs [][2]string, skipped []string, err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, e := range entries {
+		ext := filepath.Ext(e.Name())
+		if e.IsDir() || (ext != ".crt" && ext != ".pem") {
+			continue
+		}
+		certFile := filepath.Join(dir, e.Name())
+		keyFile := strings.TrimSuffix(certFile, ext) + ".key"
+		if _, err := os.Stat(keyFile); err != nil {
+			if ext != ".pem" || !pemHasKey(certFile) {
+				skipped = append(skipped, certFile)
+				continue
+			}
+			keyFile = certFile
+		}
+		pairs = append(pairs, [2]string{certFile, keyFile})
+	}
+	return pairs, skipped, nil
+}
+
+// Whether a .pem has a private key in it along with the certificate
+func pemHasKey(file string) bool {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return false
+	}
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			return false
+		}
+		if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			return true
+		}
+	}
+}
+
+func loadCertificate(certFile, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", certFile, err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, fmt.Errorf("%v: %v", certFile, err)
+		}
+	}
+	return &cert, nil
+}
+
+// The host names a certificate is good for.  The common name only counts
+// when there are no DNS names.
+func certificateNames(leaf *x509.Certificate) []string {
+	names := leaf.DNSNames
+	if len(names) == 0 && leaf.Subject.CommonName != "" {
+		names = []string{leaf.Subject.CommonName}
+	}
+	lower := make([]string, len(names))
+	for i, n := range names {
+		lower[i] = strings.ToLower(n)
+	}
+	return lower
+}
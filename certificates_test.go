@@ -0,0 +1,290 @@
+package falcore
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Writes a self signed certificate for names to dir/base.crt and dir/base.key
+func writeTestCertificate(t *testing.T, dir, base string, serial int64, names ...string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	ioutil.WriteFile(filepath.Join(dir, base+".crt"), certPem, 0600)
+	ioutil.WriteFile(filepath.Join(dir, base+".key"), keyPem, 0600)
+}
+
+func newTestCertificateDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "falcore-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestCertificate(t, dir, "a", 1, "a.example.com")
+	writeTestCertificate(t, dir, "b", 2, "*.b.example.com")
+	return dir
+}
+
+func certificateSerial(t *testing.T, cs *CertificateStore, name string) int64 {
+	cert, err := cs.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+	if err != nil {
+		t.Fatalf("No certificate for %v: %v", name, err)
+	}
+	return cert.Leaf.SerialNumber.Int64()
+}
+
+func TestCertificateStoreSNI(t *testing.T) {
+	dir := newTestCertificateDir(t)
+	defer os.RemoveAll(dir)
+
+	cs := NewCertificateStore()
+	if err := cs.AddDir(dir); err != nil {
+		t.Fatalf("AddDir failed: %v", err)
+	}
+	tests := []struct {
+		name   string
+		serial int64
+	}{
+		{"a.example.com", 1},
+		{"A.Example.Com.", 1},
+		{"x.b.example.com", 2},
+		{"", 1},
+		{"unknown.example.com", 1},
+	}
+	for _, test := range tests {
+		if serial := certificateSerial(t, cs, test.name); serial != test.serial {
+			t.Errorf("%q: expected certificate %v got %v", test.name, test.serial, serial)
+		}
+	}
+
+	cs.DefaultName = "*.b.example.com"
+	if serial := certificateSerial(t, cs, "unknown.example.com"); serial != 2 {
+		t.Errorf("Expected the default certificate got %v", serial)
+	}
+}
+
+func TestCertificateStoreReload(t *testing.T) {
+	dir := newTestCertificateDir(t)
+	defer os.RemoveAll(dir)
+
+	cs := NewCertificateStore()
+	if err := cs.AddDir(dir); err != nil {
+		t.Fatalf("AddDir failed: %v", err)
+	}
+
+	// a broken certificate leaves the old ones in place
+	ioutil.WriteFile(filepath.Join(dir, "a.crt"), []byte("junk"), 0600)
+	if err := cs.Reload(); err == nil {
+		t.Errorf("Expected Reload to fail")
+	}
+	if serial := certificateSerial(t, cs, "a.example.com"); serial != 1 {
+		t.Errorf("Expected the old certificate got %v", serial)
+	}
+
+	// Watch picks up the rotated certificate
+	writeTestCertificate(t, dir, "a", 3, "a.example.com")
+	quit := make(chan int)
+	defer close(quit)
+	go cs.Watch(10*time.Millisecond, quit)
+	for i := 0; i < 100 && certificateSerial(t, cs, "a.example.com") != 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if serial := certificateSerial(t, cs, "a.example.com"); serial != 3 {
+		t.Errorf("Expected the rotated certificate got %v", serial)
+	}
+}
+
+func TestServerTLSCertificates(t *testing.T) {
+	dir := newTestCertificateDir(t)
+	defer os.RemoveAll(dir)
+
+	srv := newTestServer(t, helloFilter)
+	srv.TLSCertificates = NewCertificateStore()
+	if err := srv.TLSCertificates.AddDir(dir); err != nil {
+		t.Fatalf("AddDir failed: %v", err)
+	}
+	srv.TLSMinVersion = tls.VersionTLS13
+	go srv.ListenAndServeTLS("", "")
+	<-srv.AcceptReady
+	defer srv.StopAccepting()
+	addr := fmt.Sprintf("localhost:%v", srv.Port())
+
+	c, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "x.b.example.com", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("TLS handshake failed: %v", err)
+	}
+	if serial := c.ConnectionState().PeerCertificates[0].SerialNumber.Int64(); serial != 2 {
+		t.Errorf("Expected the wildcard certificate got %v", serial)
+	}
+	if _, body := roundTrip(t, c, bufio.NewReader(c), "GET / HTTP/1.1\r\nHost: test\r\n\r\n"); body != "hello" {
+		t.Errorf("Expected a response over TLS: %q", body)
+	}
+	c.Close()
+
+	if c, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12}); err == nil {
+		c.Close()
+		t.Errorf("Expected TLS 1.2 to be refused")
+	}
+}
+
+// Creates a CA and a client certificate signed by it
+func newTestClientCertificate(t *testing.T) (*x509.CertPool, tls.Certificate) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(10),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDer)
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:   big.NewInt(11),
+		Subject:        pkix.Name{CommonName: "billing"},
+		DNSNames:       []string{"billing.internal"},
+		EmailAddresses: []string{"ops@example.com"},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	return pool, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func peerFilter(req *Request) *http.Response {
+	subject, ok := req.PeerSubject()
+	if !ok {
+		return SimpleResponse(req.HttpRequest, 403, nil, "no client certificate")
+	}
+	body := fmt.Sprintf("%v %v %v", subject.CommonName, strings.Join(req.PeerSANs(), ","), len(req.VerifiedPeerChain()))
+	return SimpleResponse(req.HttpRequest, 200, nil, body)
+}
+
+func TestServerClientAuth(t *testing.T) {
+	dir := newTestCertificateDir(t)
+	defer os.RemoveAll(dir)
+	pool, clientCert := newTestClientCertificate(t)
+
+	srv := newTestServer(t, peerFilter)
+	srv.TLSClientAuth = tls.VerifyClientCertIfGiven
+	srv.TLSClientCAs = pool
+	go srv.ListenAndServeTLS(filepath.Join(dir, "a.crt"), filepath.Join(dir, "a.key"))
+	<-srv.AcceptReady
+	defer srv.StopAccepting()
+	addr := fmt.Sprintf("localhost:%v", srv.Port())
+
+	tests := []struct {
+		name   string
+		certs  []tls.Certificate
+		status int
+		body   string
+	}{
+		{"with certificate", []tls.Certificate{clientCert}, 200, "billing billing.internal,ops@example.com 2"},
+		{"without certificate", nil, 403, "no client certificate"},
+	}
+	for _, test := range tests {
+		c, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, Certificates: test.certs})
+		if err != nil {
+			t.Fatalf("%v: TLS handshake failed: %v", test.name, err)
+		}
+		res, body := roundTrip(t, c, bufio.NewReader(c), "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+		if res.StatusCode != test.status || body != test.body {
+			t.Errorf("%v: expected %v %q got %v %q", test.name, test.status, test.body, res.StatusCode, body)
+		}
+		c.Close()
+	}
+}
+
+func TestCertificateStoreBadAdd(t *testing.T) {
+	dir := newTestCertificateDir(t)
+	defer os.RemoveAll(dir)
+
+	cs := NewCertificateStore()
+	if err := cs.AddDir(dir); err != nil {
+		t.Fatalf("AddDir failed: %v", err)
+	}
+	if err := cs.AddFile(filepath.Join(dir, "missing.crt"), filepath.Join(dir, "missing.key")); err == nil {
+		t.Errorf("Expected AddFile to fail")
+	}
+	if err := cs.AddDir(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("Expected AddDir to fail")
+	}
+	// the failed adds aren't kept around to break every reload after
+	if err := cs.Reload(); err != nil {
+		t.Errorf("Expected Reload to work: %v", err)
+	}
+}
+
+func TestCertificateStoreDirSkipsKeyless(t *testing.T) {
+	dir := newTestCertificateDir(t)
+	defer os.RemoveAll(dir)
+	// a chain.pem has certificates but no key
+	chain, _ := ioutil.ReadFile(filepath.Join(dir, "b.crt"))
+	ioutil.WriteFile(filepath.Join(dir, "chain.pem"), chain, 0600)
+	// a combined .pem has both
+	writeTestCertificate(t, dir, "c", 4, "c.example.com")
+	cert, _ := ioutil.ReadFile(filepath.Join(dir, "c.crt"))
+	key, _ := ioutil.ReadFile(filepath.Join(dir, "c.key"))
+	os.Remove(filepath.Join(dir, "c.crt"))
+	os.Remove(filepath.Join(dir, "c.key"))
+	ioutil.WriteFile(filepath.Join(dir, "c.pem"), append(cert, key...), 0600)
+
+	cs := NewCertificateStore()
+	if err := cs.AddDir(dir); err != nil {
+		t.Fatalf("AddDir failed: %v", err)
+	}
+	if serial := certificateSerial(t, cs, "c.example.com"); serial != 4 {
+		t.Errorf("Expected the combined certificate got %v", serial)
+	}
+	if len(cs.certs) != 3 {
+		t.Errorf("Expected the chain to be skipped: %v certificates", len(cs.certs))
+	}
+}
@@ -46,7 +46,7 @@ func (c *Filter) FilterResponse(request *falcore.Request, res *http.Response) {
 		}
 
 		if !compress {
-			request.CurrentStage.Status = 1 // Skip
+			request.CurrentStage.Status = falcore.StatusSkip
 			return
 		}
 
@@ -69,12 +69,12 @@ func (c *Filter) FilterResponse(request *falcore.Request, res *http.Response) {
 			comp, err := flate.NewWriter(buf, -1)
 			if err != nil {
 				falcore.Error("Compression Error: %v", err)
-				request.CurrentStage.Status = 1 // Skip
+				request.CurrentStage.Status = falcore.StatusSkip
 				return
 			}
 			compressor = comp
 		default:
-			request.CurrentStage.Status = 1 // Skip
+			request.CurrentStage.Status = falcore.StatusSkip
 			return
 		}
 
@@ -93,7 +93,7 @@ func (c *Filter) FilterResponse(request *falcore.Request, res *http.Response) {
 		res.Body = (*filteredBody)(buf)
 		res.Header.Set("Content-Encoding", mode)
 	} else {
-		request.CurrentStage.Status = 1 // Skip
+		request.CurrentStage.Status = falcore.StatusSkip
 	}
 }
 
@@ -0,0 +1,47 @@
+package falcore
+
+import (
+	"net"
+)
+
+// State of a connection as reported to Server.ConnState
+type ConnState int
+
+const (
+	// Accepted but no request has arrived yet
+	ConnNew ConnState = iota
+	// Reading or serving a request.  HTTP/2 connections stay active
+	// until they close.
+	ConnActive
+	// Keep-alive connection waiting for its next request
+	ConnIdle
+	// Taken over by an UpgradeHandler
+	ConnHijacked
+	// Closed.  This is the last state.
+	ConnClosed
+)
+
+var connStateNames = map[ConnState]string{
+	ConnNew:      "new",
+	ConnActive:   "active",
+	ConnIdle:     "idle",
+	ConnHijacked: "hijacked",
+	ConnClosed:   "closed",
+}
+
+func (s ConnState) String() string {
+	return connStateNames[s]
+}
+
+func (srv *Server) connStateChanged(c net.Conn, state ConnState, requests int) {
+	if srv.ConnState == nil {
+		return
+	}
+	defer func() {
+		if v := recover(); v != nil {
+			Error("%s PANIC in ConnState: %v", srv.serverLogPrefix(), v)
+			srv.stats.panics.Add(1)
+		}
+	}()
+	srv.ConnState(c, state, requests)
+}
@@ -0,0 +1,83 @@
+package falcore
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Records the states of every connection as "state/requests"
+func connStateRecorder(srv *Server) chan string {
+	states := make(chan string, 100)
+	srv.ConnState = func(c net.Conn, state ConnState, requests int) {
+		states <- fmt.Sprintf("%v/%v", state, requests)
+	}
+	return states
+}
+
+func expectConnStates(t *testing.T, states chan string, expected ...string) {
+	for _, e := range expected {
+		select {
+		case s := <-states:
+			if s != e {
+				t.Errorf("Expected %v got %v", e, s)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %v", e)
+		}
+	}
+}
+
+func TestServerConnState(t *testing.T) {
+	srv := newTestServer(t, echoUpgradeFilter)
+	states := connStateRecorder(srv)
+	startTestServer(srv)
+	defer srv.Shutdown(time.Now().Add(time.Second))
+
+	c, br := dialTestServer(t, srv)
+	roundTrip(t, c, br, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+	roundTrip(t, c, br, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+	c.Close()
+	expectConnStates(t, states, "new/0", "active/0", "idle/1", "active/1", "idle/2", "closed/2")
+
+	c, br = dialTestServer(t, srv)
+	io.WriteString(c, "GET /echo HTTP/1.1\r\nHost: test\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	if res, err := http.ReadResponse(br, nil); err != nil || res.StatusCode != 101 {
+		t.Fatalf("Expected 101 Switching Protocols: %v %v", res, err)
+	}
+	c.Close()
+	expectConnStates(t, states, "new/0", "active/0", "hijacked/1", "closed/1")
+}
+
+func TestServerConnStateBlocking(t *testing.T) {
+	srv := newTestServer(t, echoUpgradeFilter)
+	release := make(chan int)
+	first := make(chan int, 1)
+	first <- 1
+	srv.ConnState = func(c net.Conn, state ConnState, requests int) {
+		if state != ConnNew {
+			return
+		}
+		select {
+		case <-first:
+			// holds up the first connection but not the accept loop
+			<-release
+		default:
+		}
+	}
+	startTestServer(srv)
+	defer srv.Shutdown(time.Now().Add(time.Second))
+	defer close(release)
+
+	c1, _ := dialTestServer(t, srv)
+	defer c1.Close()
+	time.Sleep(50 * time.Millisecond)
+	c2, br := dialTestServer(t, srv)
+	defer c2.Close()
+	if res, _ := roundTrip(t, c2, br, "GET / HTTP/1.1\r\nHost: test\r\n\r\n"); res.StatusCode != 200 {
+		t.Errorf("Expected the second connection to be served: %v", res.StatusCode)
+	}
+}
@@ -2,8 +2,16 @@ package falcore
 
 import (
 	"io"
+	"net/http"
+	"strings"
 )
 
+// Whether the client is waiting for 100 Continue before it sends the
+// body.  HTTP/1.0 clients can't ask for it.  See RFC 7231 section 5.1.1.
+func expectsContinue(req *http.Request) bool {
+	return req.ProtoAtLeast(1, 1) && strings.EqualFold(req.Header.Get("Expect"), "100-continue")
+}
+
 type continueReader struct {
 	req    *Request
 	r      io.ReadCloser
@@ -14,18 +22,57 @@ var _ io.ReadCloser = new(continueReader)
 
 func (r *continueReader) Read(p []byte) (int, error) {
 	// sent 100 continue the first time we try to read the body
-	if !r.opened {
-		resp := SimpleResponse(r.req.HttpRequest, 100, nil, "")
-		if err := resp.Write(r.req.Connection); err != nil {
-			return 0, err
-		}
-		r.req = nil
-		r.opened = true
+	if err := r.sendContinue(); err != nil {
+		return 0, err
 	}
 	return r.r.Read(p)
 }
 
+func (r *continueReader) sendContinue() error {
+	if r.opened {
+		return nil
+	}
+	resp := SimpleResponse(r.req.HttpRequest, 100, nil, "")
+	if err := resp.Write(r.req.Connection); err != nil {
+		return err
+	}
+	if r.req.srv != nil {
+		// the socket is corked and this is all that's going out for now
+		r.req.srv.cycleNonBlock(r.req.Connection)
+	}
+	r.req = nil
+	r.opened = true
+	return nil
+}
+
 func (r *continueReader) Close() error {
+	// too late to ask for the body now
 	r.req = nil
+	r.opened = true
 	return r.r.Close()
 }
+
+// Sends 100 Continue right away instead of when the body is first read.
+// Does nothing if the client didn't ask for it, it's already been sent or
+// the request is HTTP/2, where net/http takes care of it.
+func (fReq *Request) Continue() error {
+	if fReq.expectContinue == nil {
+		return nil
+	}
+	return fReq.expectContinue.sendContinue()
+}
+
+// Runs the Server's ExpectContinue filter
+func (srv *Server) checkExpectContinue(request *Request) *http.Response {
+	request.startPipelineStage("server.ExpectContinue")
+	defer request.finishPipelineStage()
+	var res *http.Response
+	if pres := protect(request, func() { res = srv.ExpectContinue.FilterRequest(request) }); pres != nil {
+		res = pres
+	}
+	if res != nil {
+		// the body is never going to be read
+		res.Close = true
+	}
+	return res
+}
@@ -0,0 +1,105 @@
+package falcore
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Reads a response from br and fails the test if it isn't status
+func expectStatus(t *testing.T, br *bufio.Reader, status int) *http.Response {
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("Read response failed: %v", err)
+	}
+	if res.StatusCode != status {
+		t.Errorf("Expected %v got %v", status, res.StatusCode)
+	}
+	return res
+}
+
+func newContinueTestServer(t *testing.T) *Server {
+	srv := newTestServer(t, func(req *Request) *http.Response {
+		b, _ := ioutil.ReadAll(req.HttpRequest.Body)
+		return SimpleResponse(req.HttpRequest, 200, nil, string(b))
+	})
+	srv.ExpectContinue = NewRequestFilter(func(req *Request) *http.Response {
+		switch req.HttpRequest.Header.Get("X-Decision") {
+		case "reject":
+			return SimpleResponse(req.HttpRequest, 417, nil, "")
+		case "now":
+			req.Continue()
+		}
+		return nil
+	})
+	return srv
+}
+
+func TestExpectContinueReject(t *testing.T) {
+	srv := newContinueTestServer(t)
+	startTestServer(srv)
+	defer srv.Shutdown(time.Now().Add(time.Second))
+
+	c, br := dialTestServer(t, srv)
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	io.WriteString(c, "POST / HTTP/1.1\r\nHost: test\r\nContent-Length: 5\r\nExpect: 100-continue\r\nX-Decision: reject\r\n\r\n")
+	if res := expectStatus(t, br, 417); !res.Close {
+		t.Errorf("Expected Connection: close")
+	}
+	if !connClosed(c, br) {
+		t.Errorf("Expected the connection to be closed")
+	}
+}
+
+func TestExpectContinueOnRead(t *testing.T) {
+	srv := newContinueTestServer(t)
+	startTestServer(srv)
+	defer srv.Shutdown(time.Now().Add(time.Second))
+
+	for _, decision := range []string{"now", "read"} {
+		c, br := dialTestServer(t, srv)
+		c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		io.WriteString(c, "POST / HTTP/1.1\r\nHost: test\r\nContent-Length: 5\r\nExpect: 100-continue\r\nX-Decision: "+decision+"\r\n\r\n")
+		start := time.Now()
+		expectStatus(t, br, 100)
+		if d := time.Since(start); d > 100*time.Millisecond {
+			t.Errorf("%v: 100 Continue took %v", decision, d)
+		}
+		if _, body := roundTrip(t, c, br, "hello"); body != "hello" {
+			t.Errorf("%v: Expected the body to be echoed got %q", decision, body)
+		}
+		// still usable
+		if res, _ := roundTrip(t, c, br, "GET / HTTP/1.1\r\nHost: test\r\n\r\n"); res.StatusCode != 200 {
+			t.Errorf("%v: Expected 200 got %v", decision, res.StatusCode)
+		}
+		c.Close()
+	}
+}
+
+func TestExpectContinueHTTP10(t *testing.T) {
+	srv := newTestServer(t, helloFilter)
+	startTestServer(srv)
+	defer srv.Shutdown(time.Now().Add(time.Second))
+
+	// HTTP/1.0 clients don't get 100 Continue
+	c, br := dialTestServer(t, srv)
+	defer c.Close()
+	if res, _ := roundTrip(t, c, br, "POST / HTTP/1.0\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\nhello"); res.StatusCode != 200 {
+		t.Errorf("Expected 200 got %v", res.StatusCode)
+	}
+}
+
+func TestContinueAfterClose(t *testing.T) {
+	r := &continueReader{req: validGetRequest(), r: ioutil.NopCloser(new(bytes.Buffer))}
+	req := r.req
+	req.expectContinue = r
+	r.Close()
+	if err := req.Continue(); err != nil {
+		t.Errorf("Expected Continue after the body is closed to do nothing: %v", err)
+	}
+}
@@ -0,0 +1,179 @@
+package falcore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+)
+
+// A RequestFilter that can fail.  When a Pipeline runs one, an error
+// fails the stage, is recorded on its PipelineStageStat and is turned
+// into a response by the Pipeline's ErrorRenderer.  A response returned
+// along with an error is sent instead of the rendered one.
+type ErrorFilter interface {
+	FilterRequestErr(req *Request) (*http.Response, error)
+}
+
+// Helper to create an ErrorFilter by just passing in a func
+//
+//	filter = NewErrorFilter(func(req *Request) (*http.Response, error) {
+//		if req.HttpRequest.Header.Get("X-Api-Key") == "" {
+//			return nil, NewHTTPError(401, "missing API key", nil)
+//		}
+//		return nil, nil
+//	})
+//
+// The filter is also a RequestFilter, for routers and anything else that
+// wants one.  Errors are rendered with RenderErrorText outside a Pipeline.
+func NewErrorFilter(f func(req *Request) (*http.Response, error)) RequestFilter {
+	return &genericErrorFilter{f}
+}
+
+type genericErrorFilter struct {
+	f func(req *Request) (*http.Response, error)
+}
+
+func (f *genericErrorFilter) FilterRequestErr(req *Request) (*http.Response, error) {
+	return f.f(req)
+}
+
+func (f *genericErrorFilter) FilterRequest(req *Request) *http.Response {
+	res, err := f.f(req)
+	if err != nil {
+		return req.failed(res, err, nil)
+	}
+	return res
+}
+
+// An error with the status it should be answered with.  Message is shown
+// to the client, unlike Err, which is only logged and recorded on the
+// stage.
+type HTTPError struct {
+	StatusCode int
+	Message    string
+	Err        error
+}
+
+func NewHTTPError(status int, message string, err error) *HTTPError {
+	return &HTTPError{StatusCode: status, Message: message, Err: err}
+}
+
+func (e *HTTPError) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = http.StatusText(e.StatusCode)
+	}
+	if e.Err != nil {
+		return fmt.Sprintf("%d %s: %v", e.StatusCode, msg, e.Err)
+	}
+	return fmt.Sprintf("%d %s", e.StatusCode, msg)
+}
+
+func (e *HTTPError) Unwrap() error {
+	return e.Err
+}
+
+// The status an error is answered with.  *HTTPError has its own,
+// cancelled requests get 503 or 504, bodies over the limit 413 and
+// anything else 500.
+func ErrorStatus(err error) int {
+	var herr *HTTPError
+	var maxErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &herr):
+		return herr.StatusCode
+	case errors.Is(err, ErrRequestTimeout):
+		return 504
+	case errors.Is(err, ErrClientDisconnected), errors.Is(err, ErrServerShutdown):
+		return 503
+	case errors.As(err, &maxErr):
+		return 413
+	}
+	return 500
+}
+
+// What the client is told about err.  Only an *HTTPError's Message gets
+// out, everything else is just the status text.
+func errorMessage(status int, err error) string {
+	var herr *HTTPError
+	if errors.As(err, &herr) && herr.Message != "" {
+		return herr.Message
+	}
+	return http.StatusText(status)
+}
+
+// Turns an error from an ErrorFilter into a response
+type ErrorRenderer func(req *Request, status int, err error) *http.Response
+
+// Plain text, like the Server's own error responses
+func RenderErrorText(req *Request, status int, err error) *http.Response {
+	headers := make(http.Header)
+	headers.Set("Content-Type", "text/plain; charset=utf-8")
+	return SimpleResponse(req.HttpRequest, status, headers, errorMessage(status, err)+"\n")
+}
+
+func RenderErrorHTML(req *Request, status int, err error) *http.Response {
+	headers := make(http.Header)
+	headers.Set("Content-Type", "text/html; charset=utf-8")
+	title := html.EscapeString(fmt.Sprintf("%d %s", status, http.StatusText(status)))
+	body := fmt.Sprintf("<html><head><title>%s</title></head><body><h1>%s</h1><p>%s</p></body></html>\n",
+		title, title, html.EscapeString(errorMessage(status, err)))
+	return SimpleResponse(req.HttpRequest, status, headers, body)
+}
+
+// {"status": 404, "error": "Not Found"}
+func RenderErrorJSON(req *Request, status int, err error) *http.Response {
+	return jsonErrorResponse(req, status, "application/json", map[string]interface{}{
+		"status": status,
+		"error":  errorMessage(status, err),
+	})
+}
+
+// An RFC 7807 problem details object
+func RenderProblemJSON(req *Request, status int, err error) *http.Response {
+	problem := map[string]interface{}{
+		"type":   "about:blank",
+		"title":  http.StatusText(status),
+		"status": status,
+	}
+	if msg := errorMessage(status, err); msg != http.StatusText(status) {
+		problem["detail"] = msg
+	}
+	if req.HttpRequest.URL != nil {
+		problem["instance"] = req.HttpRequest.URL.Path
+	}
+	return jsonErrorResponse(req, status, "application/problem+json", problem)
+}
+
+func jsonErrorResponse(req *Request, status int, contentType string, v interface{}) *http.Response {
+	body, _ := json.Marshal(v)
+	headers := make(http.Header)
+	headers.Set("Content-Type", contentType)
+	return SimpleResponse(req.HttpRequest, status, headers, string(body)+"\n")
+}
+
+// Records err on the CurrentStage and fails it.  For RequestFilters that
+// build their own error responses.
+func (fReq *Request) Fail(err error) {
+	if fReq.CurrentStage != nil {
+		fReq.CurrentStage.Status = StatusFail
+		fReq.CurrentStage.Err = err
+	}
+}
+
+// Fails the stage and returns res, or renders err if res is nil
+func (fReq *Request) failed(res *http.Response, err error, render ErrorRenderer) *http.Response {
+	fReq.Fail(err)
+	if res != nil {
+		return res
+	}
+	status := ErrorStatus(err)
+	if render != nil {
+		if res = render(fReq, status, err); res != nil {
+			return res
+		}
+	}
+	return RenderErrorText(fReq, status, err)
+}
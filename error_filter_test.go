@@ -0,0 +1,113 @@
+package falcore
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+var errBackend = errors.New("backend exploded")
+
+func TestPipelineErrorFilter(t *testing.T) {
+	p := NewPipeline()
+	p.Upstream.PushBack(NewErrorFilter(func(req *Request) (*http.Response, error) {
+		return nil, errBackend
+	}))
+	p.Upstream.PushBack(NewRequestFilter(helloFilter))
+
+	req := validGetRequest()
+	res := p.execute(req)
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != 500 || string(body) != "Internal Server Error\n" {
+		t.Errorf("Expected a plain 500 without the error got %v %q", res.StatusCode, body)
+	}
+	pss := req.PipelineStageStats.Front().Value.(*PipelineStageStat)
+	if pss.Status != StatusFail || pss.Err != errBackend {
+		t.Errorf("Expected the error on the stage got %v %v", pss.Status, pss.Err)
+	}
+	if req.PipelineStageStats.Len() != 1 {
+		t.Errorf("Expected the pipeline to stop at the error: %v stages", req.PipelineStageStats.Len())
+	}
+}
+
+var errorStatusTests = []struct {
+	err    error
+	status int
+}{
+	{errBackend, 500},
+	{NewHTTPError(404, "", nil), 404},
+	{NewHTTPError(502, "upstream down", errBackend), 502},
+	{ErrRequestTimeout, 504},
+	{ErrClientDisconnected, 503},
+	{&http.MaxBytesError{Limit: 10}, 413},
+}
+
+func TestErrorStatus(t *testing.T) {
+	for _, test := range errorStatusTests {
+		if status := ErrorStatus(test.err); status != test.status {
+			t.Errorf("%v: Expected %v got %v", test.err, test.status, status)
+		}
+	}
+}
+
+func TestErrorRenderers(t *testing.T) {
+	err := NewHTTPError(404, "no such <widget>", errBackend)
+	for _, test := range []struct {
+		render      ErrorRenderer
+		contentType string
+		contains    string
+	}{
+		{RenderErrorText, "text/plain; charset=utf-8", "no such <widget>\n"},
+		{RenderErrorHTML, "text/html; charset=utf-8", "<p>no such &lt;widget&gt;</p>"},
+		{RenderErrorJSON, "application/json", `"error":"no such \u003cwidget\u003e"`},
+		{RenderProblemJSON, "application/problem+json", `"detail":"no such \u003cwidget\u003e"`},
+	} {
+		p := NewPipeline()
+		p.ErrorRenderer = test.render
+		p.Upstream.PushBack(NewErrorFilter(func(req *Request) (*http.Response, error) {
+			return nil, err
+		}))
+		res := p.execute(validGetRequest())
+		body, _ := ioutil.ReadAll(res.Body)
+		if res.StatusCode != 404 || res.Header.Get("Content-Type") != test.contentType {
+			t.Errorf("Expected a 404 %v got %v %v", test.contentType, res.StatusCode, res.Header)
+		}
+		if !strings.Contains(string(body), test.contains) || strings.Contains(string(body), errBackend.Error()) {
+			t.Errorf("Expected %q without the wrapped error got %q", test.contains, body)
+		}
+	}
+
+	res := RenderProblemJSON(validGetRequest(), 500, errBackend)
+	var problem map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&problem); err != nil {
+		t.Fatalf("Expected JSON: %v", err)
+	}
+	if problem["status"] != float64(500) || problem["title"] != "Internal Server Error" || problem["instance"] != "/hello" {
+		t.Errorf("Unexpected problem: %v", problem)
+	}
+	if _, ok := problem["detail"]; ok {
+		t.Errorf("Expected no detail for a plain error: %v", problem)
+	}
+}
+
+func TestErrorFilterResponse(t *testing.T) {
+	// a response returned with the error is used as is
+	ef := NewErrorFilter(func(req *Request) (*http.Response, error) {
+		return SimpleResponse(req.HttpRequest, 503, nil, "custom"), errBackend
+	})
+	router := NewRouter(func(req *Request) RequestFilter {
+		return ef
+	})
+	p := NewPipeline()
+	p.Upstream.PushBack(router)
+	req := validGetRequest()
+	if res := p.execute(req); res.StatusCode != 503 {
+		t.Errorf("Expected the filter's response got %v", res.StatusCode)
+	}
+	if pss := req.PipelineStageStats.Back().Value.(*PipelineStageStat); pss.Err != errBackend {
+		t.Errorf("Expected the error on the routed stage got %v", pss.Err)
+	}
+}
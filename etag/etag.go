@@ -19,7 +19,7 @@ type Filter struct {
 }
 
 func (f *Filter) FilterResponse(request *falcore.Request, res *http.Response) {
-	request.CurrentStage.Status = 1 // Skipped (default)
+	request.CurrentStage.Status = falcore.StatusSkip // (default)
 	if if_none_match := request.HttpRequest.Header.Get("If-None-Match"); if_none_match != "" {
 		if res.StatusCode == 200 && res.Header.Get("Etag") == if_none_match {
 			res.StatusCode = 304
@@ -27,7 +27,7 @@ func (f *Filter) FilterResponse(request *falcore.Request, res *http.Response) {
 			res.Body.Close()
 			res.Body = nil
 			res.ContentLength = 0
-			request.CurrentStage.Status = 0 // Success
+			request.CurrentStage.Status = falcore.StatusSuccess
 		}
 	}
 }
@@ -39,7 +39,7 @@ func (f delayFilter) FilterRequest(req *falcore.Request) *http.Response {
 	if status == 0 {
 		time.Sleep(time.Duration(rand.Int63n(100e6))) // random sleep between 0 and 100 ms
 	}
-	req.CurrentStage.Status = byte(status) // set the status to produce a unique signature
+	req.CurrentStage.Status = falcore.PipelineStatus(status) // set the status to produce a unique signature
 	return nil
 }
 
@@ -0,0 +1,204 @@
+package falcore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// HTTP/2 frame types and flags needed to hand over an upgraded request
+const (
+	http2FrameHeaders      = 0x1
+	http2FrameSettings     = 0x4
+	http2FrameContinuation = 0x9
+	http2FlagEndStream     = 0x1
+	http2FlagEndHeaders    = 0x4
+	http2FrameHeaderLen    = 9
+	// SETTINGS_MAX_FRAME_SIZE until the peer says otherwise
+	http2DefaultMaxFrameSize = 16384
+)
+
+// Upgrades an HTTP/1.1 request with "Upgrade: h2c" to HTTP/2 if H2C is
+// enabled.  See RFC 7540 section 3.2.  The request becomes stream 1 of
+// the HTTP/2 connection and is answered there.  Returns false if the
+// request should be served as HTTP/1.
+//
+// Requests with a body, and requests the client pipelined more requests
+// behind, are served as HTTP/1 and the Upgrade is ignored, which the RFC
+// allows.
+func (srv *Server) upgradeH2C(c net.Conn, br *bufio.Reader, req *http.Request) bool {
+	if srv.http2 == nil || !srv.H2C || !isH2CUpgrade(req) || srv.stopping() {
+		return false
+	}
+	if _, isTLS := c.(*tls.Conn); isTLS || req.Body != http.NoBody || br.Buffered() > 0 {
+		return false
+	}
+	srv.countConnRequest(c)
+	// the client waits for this before it sends the preface
+	srv.uncork(c)
+	if _, err := io.WriteString(c, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n"); err != nil {
+		return true
+	}
+	timeout := srv.ReadHeaderTimeout
+	if timeout == 0 {
+		timeout = srv.ReadTimeout
+	}
+	if timeout > 0 {
+		c.SetReadDeadline(time.Now().Add(timeout))
+	}
+	start, err := readH2CPreface(br)
+	if err != nil {
+		if err != io.EOF && !isTimeout(err) {
+			Error("%s %v ERROR in h2c upgrade: %v", srv.serverLogPrefix(), c.RemoteAddr(), err)
+		}
+		return true
+	}
+	// the HTTP/2 server sees the request as if it came in as a HEADERS
+	// frame right after the client's SETTINGS
+	start = append(start, h2cHeadersFrames(h2cHeaderBlock(req))...)
+	srv.startHTTP2(c, &bufferedConn{Conn: c, br: bufio.NewReader(io.MultiReader(bytes.NewReader(start), br))})
+	return true
+}
+
+// A request asking to switch to h2c with valid HTTP2-Settings.  The
+// settings themselves aren't applied.  The client has to send a SETTINGS
+// frame after its preface as well, and the HTTP/2 server reads that before
+// the request's stream.
+func isH2CUpgrade(req *http.Request) bool {
+	if !req.ProtoAtLeast(1, 1) || req.Method == "CONNECT" {
+		return false
+	}
+	if !headerHasToken(req.Header, "Upgrade", "h2c") || !headerHasToken(req.Header, "Connection", "Upgrade") ||
+		!headerHasToken(req.Header, "Connection", "HTTP2-Settings") {
+		return false
+	}
+	settings := req.Header["Http2-Settings"]
+	if len(settings) != 1 {
+		return false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(settings[0], "="))
+	return err == nil && len(b)%6 == 0
+}
+
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, v := range header[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Reads the client's preface and the SETTINGS frame that has to follow it
+func readH2CPreface(br *bufio.Reader) ([]byte, error) {
+	head, err := br.Peek(len(http2Preface) + http2FrameHeaderLen)
+	if err != nil {
+		return nil, err
+	}
+	frame := head[len(http2Preface):]
+	if !bytes.Equal(head[:len(http2Preface)], http2Preface) || frame[3] != http2FrameSettings {
+		return nil, errors.New("No HTTP/2 preface after the upgrade")
+	}
+	length := int(frame[0])<<16 | int(frame[1])<<8 | int(frame[2])
+	if length > http2DefaultMaxFrameSize {
+		return nil, errors.New("SETTINGS frame too large")
+	}
+	start := make([]byte, len(head)+length)
+	_, err = io.ReadFull(br, start)
+	return start, err
+}
+
+// The request's headers HPACK encoded as literals, so no dynamic table
+// state is left behind for the HTTP/2 server to disagree with
+func h2cHeaderBlock(req *http.Request) []byte {
+	var b []byte
+	field := func(name, value string) {
+		// literal header field without indexing, new name
+		b = append(b, 0)
+		b = hpackString(b, name)
+		b = hpackString(b, value)
+	}
+	field(":method", req.Method)
+	field(":scheme", "http")
+	if req.Host != "" {
+		field(":authority", req.Host)
+	}
+	path := req.RequestURI
+	if req.URL.IsAbs() {
+		path = req.URL.RequestURI()
+	}
+	field(":path", path)
+
+	// connection specific headers mean nothing in HTTP/2
+	skip := map[string]bool{"host": true, "http2-settings": true}
+	for _, k := range http2HopHeaders {
+		skip[strings.ToLower(k)] = true
+	}
+	for _, v := range req.Header["Connection"] {
+		for _, t := range strings.Split(v, ",") {
+			skip[strings.ToLower(strings.TrimSpace(t))] = true
+		}
+	}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if skip[lower] {
+			continue
+		}
+		for _, v := range values {
+			if lower == "te" && !strings.EqualFold(v, "trailers") {
+				continue
+			}
+			field(lower, v)
+		}
+	}
+	return b
+}
+
+// Stream 1's HEADERS frame, with CONTINUATION frames for the rest of a
+// block too big for one frame.  There's no body so the stream ends with
+// the headers.
+func h2cHeadersFrames(block []byte) []byte {
+	var b []byte
+	typ, flags := byte(http2FrameHeaders), byte(http2FlagEndStream)
+	for first := true; first || len(block) > 0; first = false {
+		n := len(block)
+		if n > http2DefaultMaxFrameSize {
+			n = http2DefaultMaxFrameSize
+		}
+		if n == len(block) {
+			flags |= http2FlagEndHeaders
+		}
+		b = append(b, byte(n>>16), byte(n>>8), byte(n), typ, flags, 0, 0, 0, 1)
+		b = append(b, block[:n]...)
+		block = block[n:]
+		typ, flags = http2FrameContinuation, 0
+	}
+	return b
+}
+
+// An HPACK string literal without Huffman coding
+func hpackString(b []byte, s string) []byte {
+	return append(hpackInt(b, 7, len(s)), s...)
+}
+
+// An HPACK integer with an n bit prefix.  See RFC 7541 section 5.1.
+func hpackInt(b []byte, n uint, i int) []byte {
+	max := 1<<n - 1
+	if i < max {
+		return append(b, byte(i))
+	}
+	b = append(b, byte(max))
+	for i -= max; i >= 128; i >>= 7 {
+		b = append(b, byte(i&0x7F)|0x80)
+	}
+	return append(b, byte(i))
+}
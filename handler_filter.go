@@ -22,23 +22,47 @@ func (h *HandlerFilter) FilterRequest(req *Request) *http.Response {
 	// this must be done concurrently so that the HandlerFunc can write the response
 	// while falcore is copying it to the socket
 	go func() {
+		defer func() {
+			if v := recover(); v != nil {
+				req.logPanic("HandlerFilter", v)
+				rw.abort()
+			}
+		}()
 		h.handler.ServeHTTP(rw, req.HttpRequest)
 		rw.finish()
 	}()
-	return <-respc
+	select {
+	case res := <-respc:
+		if res == nil {
+			// the handler panicked before writing anything
+			return req.panicResponse()
+		}
+		return res
+	case <-req.Done():
+		// the handler sees the cancellation through HttpRequest.Context().
+		// any more writes fail instead of blocking on the pipe.
+		rw.pr.CloseWithError(req.Err())
+		// not the handler's fault so the stage is skipped, like the
+		// upstream filter does
+		req.CurrentStage.Status = StatusSkip
+		req.CurrentStage.Err = req.Err()
+		return SimpleResponse(req.HttpRequest, ErrorStatus(req.Err()), nil, "Request cancelled\n")
+	}
 }
 
 // copied from net/http/filetransport.go
 func newPopulateResponseWriter(req *http.Request) (*populateResponse, <-chan *http.Response) {
 	pr, pw := io.Pipe()
 	rw := &populateResponse{
-		ch: make(chan *http.Response),
+		// buffered so the handler doesn't block if nobody's waiting
+		ch: make(chan *http.Response, 1),
+		pr: pr,
 		pw: pw,
 		res: &http.Response{
-			Proto:      "HTTP/1.0",
+			Proto:      "HTTP/1.1",
 			ProtoMajor: 1,
+			ProtoMinor: 1,
 			Header:     make(http.Header),
-			Close:      true,
 			Body:       pr,
 			Request:    req,
 		},
@@ -56,6 +80,7 @@ type populateResponse struct {
 	wroteHeader  bool
 	hasContent   bool
 	sentResponse bool
+	pr           *io.PipeReader
 	pw           *io.PipeWriter
 }
 
@@ -69,6 +94,16 @@ func (pr *populateResponse) finish() {
 	pr.pw.Close()
 }
 
+// Called when the handler panics.  A response that's already on its way
+// can only be cut short.
+func (pr *populateResponse) abort() {
+	if !pr.sentResponse {
+		pr.sentResponse = true
+		pr.ch <- nil
+	}
+	pr.pw.CloseWithError(errHandlerPanic)
+}
+
 func (pr *populateResponse) sendResponse() {
 	if pr.sentResponse {
 		return
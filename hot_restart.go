@@ -0,0 +1,209 @@
+// +build !windows
+
+package falcore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Environment variables used to hand state from a restarting parent to its child
+const (
+	// Listener fds for each server in the same order as HotRestarter.Servers.
+	// Servers are separated by ';' and each server's listeners by ','.
+	HotRestartListenFdsEnv = "FALCORE_LISTEN_FDS"
+	// The fd the child writes to once all of its servers are accepting
+	HotRestartReadyFdEnv = "FALCORE_READY_FD"
+)
+
+// HotRestarter implements zero downtime restarts for a set of Servers.
+//
+// On Restart, the current binary is fork/exec'ed with the listener sockets
+// passed in as open fds.  Once every server in the child is accepting,
+// the servers in the parent are gracefully shut down so ListenAndServe
+// returns and the parent can exit.  If the child doesn't become ready
+// within ReadyTimeout it is killed and the parent keeps serving.
+//
+// The same HotRestarter setup must run in the child, calling Inherit
+// before ListenAndServe:
+//
+//    hr := falcore.NewHotRestarter(srv)
+//    if _, err := hr.Inherit(); err != nil {
+//        // bad fds from the parent
+//    }
+//    go hr.RestartOnSignal(syscall.SIGHUP)
+//    srv.ListenAndServe()
+type HotRestarter struct {
+	Servers []*Server
+	// How long to wait for the child to start accepting.  Default 30 seconds.
+	ReadyTimeout time.Duration
+	// How long the parent's servers get to drain once the child is ready.
+	// Default 30 seconds.
+	DrainTimeout time.Duration
+	// Binary and arguments for the child.  Default os.Args.
+	Path string
+	Args []string
+
+	restarting sync.Mutex
+}
+
+func NewHotRestarter(servers ...*Server) *HotRestarter {
+	hr := new(HotRestarter)
+	hr.Servers = servers
+	hr.ReadyTimeout = 30 * time.Second
+	hr.DrainTimeout = 30 * time.Second
+	hr.Path = os.Args[0]
+	hr.Args = os.Args
+	return hr
+}
+
+// Sets up the servers with the listeners passed down from the parent.
+// Returns false if this process wasn't started by a HotRestarter, in
+// which case the servers will create their own listeners as usual.
+func (hr *HotRestarter) Inherit() (bool, error) {
+	fdList := os.Getenv(HotRestartListenFdsEnv)
+	if fdList == "" {
+		return false, nil
+	}
+	serverFds := strings.Split(fdList, ";")
+	if len(serverFds) != len(hr.Servers) {
+		return true, fmt.Errorf("Parent passed listeners for %d servers, expected %d", len(serverFds), len(hr.Servers))
+	}
+	for i, fds := range serverFds {
+		for _, fdStr := range strings.Split(fds, ",") {
+			fd, err := strconv.Atoi(fdStr)
+			if err != nil {
+				return true, fmt.Errorf("Bad listener fd %q: %v", fdStr, err)
+			}
+			if err = hr.Servers[i].FdListen(fd); err != nil {
+				return true, err
+			}
+		}
+	}
+
+	var ready *os.File
+	if fd, err := strconv.Atoi(os.Getenv(HotRestartReadyFdEnv)); err == nil {
+		ready = os.NewFile(uintptr(fd), "ready")
+	}
+	// don't pass these along to anything we exec
+	os.Unsetenv(HotRestartListenFdsEnv)
+	os.Unsetenv(HotRestartReadyFdEnv)
+
+	if ready != nil {
+		go func() {
+			for _, srv := range hr.Servers {
+				<-srv.accepting
+			}
+			ready.Write([]byte{1})
+			ready.Close()
+		}()
+	}
+	return true, nil
+}
+
+// Starts a new copy of this process and hands the listeners over to it.
+// On success, the servers in this process have been shut down and the
+// caller should exit.  On error, this process is still serving.
+func (hr *HotRestarter) Restart() (status ShutdownStatus, err error) {
+	hr.restarting.Lock()
+	defer hr.restarting.Unlock()
+
+	pid := syscall.Getpid()
+	var readyR, readyW *os.File
+	if readyR, readyW, err = os.Pipe(); err != nil {
+		return
+	}
+	defer readyR.Close()
+
+	// 0 = stdin, 1 = stdout, 2 = stderr, then the listeners, then the ready pipe.
+	// ForkExec dups these down to start at 0 in the child.
+	files := []uintptr{0, 1, 2}
+	var serverFds []string
+	for _, srv := range hr.Servers {
+		parentFds := srv.SocketFds()
+		if len(parentFds) == 0 {
+			readyW.Close()
+			return status, errors.New("Server isn't listening")
+		}
+		var childFds []string
+		for _, fd := range parentFds {
+			childFds = append(childFds, strconv.Itoa(len(files)))
+			files = append(files, uintptr(fd))
+		}
+		serverFds = append(serverFds, strings.Join(childFds, ","))
+	}
+	env := []string{
+		HotRestartListenFdsEnv + "=" + strings.Join(serverFds, ";"),
+		HotRestartReadyFdEnv + "=" + strconv.Itoa(len(files)),
+	}
+	files = append(files, readyW.Fd())
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, HotRestartListenFdsEnv+"=") && !strings.HasPrefix(e, HotRestartReadyFdEnv+"=") {
+			env = append(env, e)
+		}
+	}
+
+	Info("%v HotRestart forking %v", pid, hr.Path)
+	attr := &syscall.ProcAttr{Env: env, Files: files}
+	childPid, err := syscall.ForkExec(hr.Path, hr.Args, attr)
+	readyW.Close()
+	if err != nil {
+		return
+	}
+	child, _ := os.FindProcess(childPid)
+
+	// The child writes a byte once it's accepting.  EOF means it died first.
+	readyChan := make(chan bool, 1)
+	go func() {
+		n, _ := readyR.Read(make([]byte, 1))
+		readyChan <- n == 1
+	}()
+	timer := time.NewTimer(hr.ReadyTimeout)
+	defer timer.Stop()
+	select {
+	case ok := <-readyChan:
+		if !ok {
+			err = fmt.Errorf("Child %v exited before it was ready", childPid)
+		}
+	case <-timer.C:
+		err = fmt.Errorf("Child %v wasn't ready after %v", childPid, hr.ReadyTimeout)
+	}
+	if err != nil {
+		Error("%v HotRestart failed, rolling back: %v", pid, err)
+		child.Kill()
+		child.Wait()
+		return
+	}
+
+	Info("%v HotRestart child %v is ready.  Draining.", pid, childPid)
+	deadline := time.Now().Add(hr.DrainTimeout)
+	for _, srv := range hr.Servers {
+		st := srv.Shutdown(deadline)
+		status.Drained += st.Drained
+		status.Idle += st.Idle
+		status.Killed += st.Killed
+	}
+	return
+}
+
+// Calls Restart every time one of the signals is received.  Blocks until
+// a restart succeeds.
+func (hr *HotRestarter) RestartOnSignal(sig ...os.Signal) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, sig...)
+	defer signal.Stop(sigChan)
+	for s := range sigChan {
+		Info("%v Received %v.  Restarting.", syscall.Getpid(), s)
+		if status, err := hr.Restart(); err == nil {
+			Info("%v HotRestart complete %+v", syscall.Getpid(), status)
+			return
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// +build !windows
+
+package falcore
+
+import (
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+// Not a real test.  This is the child process started by TestHotRestart.
+func TestHotRestartChild(t *testing.T) {
+	if os.Getenv("FALCORE_TEST_CHILD") == "" {
+		return
+	}
+	quit := make(chan int)
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		if req.HttpRequest.URL.Path == "/quit" {
+			close(quit)
+		}
+		return SimpleResponse(req.HttpRequest, 200, nil, "child")
+	}))
+	srv := NewServer(0, pipeline)
+	if child, err := NewHotRestarter(srv).Inherit(); !child || err != nil {
+		t.Fatalf("Child didn't inherit listener: %v %v", child, err)
+	}
+	go srv.ListenAndServe()
+	select {
+	case <-quit:
+	case <-time.After(10 * time.Second):
+	}
+	srv.Shutdown(time.Now().Add(time.Second))
+}
+
+func TestHotRestart(t *testing.T) {
+	srv := newTestServer(t, helloFilter)
+	served := make(chan error)
+	go func() {
+		served <- srv.ListenAndServe()
+	}()
+	<-srv.AcceptReady
+
+	hr := NewHotRestarter(srv)
+	hr.Args = []string{os.Args[0], "-test.run=TestHotRestartChild"}
+	t.Setenv("FALCORE_TEST_CHILD", "1")
+	if _, err := hr.Restart(); err != nil {
+		t.Fatalf("Restart failed: %v", err)
+	}
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Parent server didn't stop after restart")
+	}
+
+	// the child has the listener now
+	c, br := dialTestServer(t, srv)
+	defer c.Close()
+	if _, body := roundTrip(t, c, br, "GET / HTTP/1.1\r\nHost: test\r\n\r\n"); body != "child" {
+		t.Errorf("Expected the child to answer: %q", body)
+	}
+	roundTrip(t, c, br, "GET /quit HTTP/1.1\r\nHost: test\r\n\r\n")
+}
+
+func TestHotRestartRollback(t *testing.T) {
+	srv := newTestServer(t, helloFilter)
+	startTestServer(srv)
+	defer srv.StopAccepting()
+
+	hr := NewHotRestarter(srv)
+	hr.Path = "/bin/false"
+	hr.Args = []string{"false"}
+	if _, err := hr.Restart(); err == nil {
+		t.Errorf("Restart should fail when the child exits")
+	}
+
+	// still serving
+	c, br := dialTestServer(t, srv)
+	defer c.Close()
+	if _, body := roundTrip(t, c, br, "GET / HTTP/1.1\r\nHost: test\r\n\r\n"); body != "hello" {
+		t.Errorf("Parent stopped serving after rollback: %q", body)
+	}
+}
@@ -0,0 +1,295 @@
+package falcore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The first thing an HTTP/2 client sends.  See RFC 7540 section 3.5.
+var http2Preface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+
+// Response headers that mean nothing in HTTP/2
+var http2HopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade"}
+
+type http2ContextKey struct{}
+
+// HTTP/2 framing is handled by net/http.  Connections are handed over
+// once they've negotiated h2, sent the preface or upgraded to h2c and
+// every stream is run through the Pipeline like an HTTP/1 request.
+type http2Server struct {
+	hs       *http.Server
+	listener *connListener
+	mutex    sync.Mutex
+	done     map[net.Conn]chan int
+}
+
+func newHTTP2Server(srv *Server) *http2Server {
+	h2 := &http2Server{
+		listener: newConnListener(),
+		done:     make(map[net.Conn]chan int),
+	}
+	h2.hs = &http.Server{
+		Handler:           http.HandlerFunc(srv.serveHTTP2Request),
+		ReadHeaderTimeout: srv.ReadHeaderTimeout,
+		ReadTimeout:       srv.ReadTimeout,
+		WriteTimeout:      srv.WriteTimeout,
+		IdleTimeout:       srv.IdleTimeout,
+		MaxHeaderBytes:    srv.maxHeaderBytes(),
+		ConnState:         h2.connState,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, http2ContextKey{}, c)
+		},
+	}
+	h2.hs.Protocols = new(http.Protocols)
+	h2.hs.Protocols.SetHTTP2(srv.HTTP2)
+	h2.hs.Protocols.SetUnencryptedHTTP2(srv.H2C)
+	go h2.hs.Serve(h2.listener)
+	return h2
+}
+
+// Sends GOAWAY on every connection.  They close once their streams finish.
+func (h2 *http2Server) shutdown() {
+	go h2.hs.Shutdown(context.Background())
+}
+
+// Serves the connection and blocks until it's closed
+func (h2 *http2Server) serveConn(c net.Conn) {
+	done := make(chan int)
+	h2.mutex.Lock()
+	h2.done[c] = done
+	h2.mutex.Unlock()
+	if h2.listener.push(c) {
+		<-done
+	} else {
+		h2.finished(c)
+	}
+}
+
+func (h2 *http2Server) connState(c net.Conn, state http.ConnState) {
+	if state == http.StateClosed || state == http.StateHijacked {
+		h2.finished(c)
+	}
+}
+
+func (h2 *http2Server) finished(c net.Conn) {
+	h2.mutex.Lock()
+	defer h2.mutex.Unlock()
+	if done, ok := h2.done[c]; ok {
+		close(done)
+		delete(h2.done, c)
+	}
+}
+
+// Finishes the TLS handshake and hands the connection to the HTTP/2
+// server if it negotiated h2.  This has to happen before anything is
+// read from the connection.  Returns false if the connection should be
+// served as HTTP/1.
+func (srv *Server) serveHTTP2TLS(c net.Conn) bool {
+	tc, ok := c.(*tls.Conn)
+	if !ok || srv.http2 == nil || !srv.HTTP2 {
+		return false
+	}
+	timeout := srv.ReadHeaderTimeout
+	if timeout == 0 {
+		timeout = srv.ReadTimeout
+	}
+	if timeout > 0 {
+		c.SetReadDeadline(time.Now().Add(timeout))
+	}
+	if err := tc.Handshake(); err != nil {
+		if err != io.EOF && !isTimeout(err) {
+			Error("%s %v ERROR in TLS handshake: %v", srv.serverLogPrefix(), c.RemoteAddr(), err)
+		}
+		return true
+	}
+	if tc.ConnectionState().NegotiatedProtocol != "h2" {
+		return false
+	}
+	srv.startHTTP2(c, c)
+	return true
+}
+
+// Hands the connection to the HTTP/2 server if H2C is enabled and it
+// starts with the HTTP/2 preface.  Returns false if the connection should
+// be served as HTTP/1.
+func (srv *Server) serveH2C(c net.Conn, br *bufio.Reader) bool {
+	if srv.http2 == nil || !srv.H2C {
+		return false
+	}
+	if _, isTLS := c.(*tls.Conn); isTLS || !hasHTTP2Preface(br) {
+		return false
+	}
+	// the preface has already been read into br
+	srv.startHTTP2(c, &bufferedConn{Conn: c, br: br})
+	return true
+}
+
+func (srv *Server) startHTTP2(c, h2c net.Conn) {
+	c.SetReadDeadline(time.Time{})
+	srv.setConnState(c, ConnActive)
+	srv.uncork(c)
+	srv.http2.serveConn(h2c)
+}
+
+func hasHTTP2Preface(br *bufio.Reader) bool {
+	// don't wait for 24 bytes unless it looks like HTTP/2.  short
+	// HTTP/1 requests would hang.
+	if b, err := br.Peek(3); err != nil || string(b) != "PRI" {
+		return false
+	}
+	b, err := br.Peek(len(http2Preface))
+	return err == nil && bytes.Equal(b, http2Preface)
+}
+
+// Runs an HTTP/2 stream through the Pipeline
+func (srv *Server) serveHTTP2Request(w http.ResponseWriter, req *http.Request) {
+	startTime := time.Now()
+	c, _ := req.Context().Value(http2ContextKey{}).(net.Conn)
+	req, cancel := srv.requestContext(req)
+	defer cancel(nil)
+	defer srv.recoverStream()
+	if lerr := srv.checkHeaderLimits(req); lerr != nil {
+		lerr.count.Add(1)
+		Warn("%s %v Rejected request: %v", srv.serverLogPrefix(), req.RemoteAddr, lerr.reason)
+		http.Error(w, http.StatusText(lerr.status), lerr.status)
+		return
+	}
+	request := newRequest(req, c, startTime)
+	request.srv = srv
+	if bc, ok := c.(*bufferedConn); ok {
+		srv.countConnRequest(bc.Conn)
+	} else {
+		srv.countConnRequest(c)
+	}
+	// net/http sends 100 Continue itself
+	if cr, ok := req.Body.(*continueReader); ok {
+		req.Body = cr.r
+		request.expectContinue = nil
+	}
+
+	pssInit := new(PipelineStageStat)
+	pssInit.Name = "server.Init"
+	pssInit.StartTime = startTime
+	pssInit.EndTime = time.Now()
+	request.appendPipelineStage(pssInit)
+	res := srv.execute(request)
+	if upgradeHandler(res) != nil {
+		res = SimpleResponse(req, 400, nil, "Upgrade isn't supported over HTTP/2\n")
+	}
+
+	request.startPipelineStage("server.ResponseWrite")
+	req.Body.Close()
+	werr := srv.writeHTTP2Response(w, req, res)
+	if res.Body != nil {
+		res.Body.Close()
+	}
+	if werr != nil && isTimeout(werr) {
+		request.CurrentStage.Status = StatusTimeout
+	}
+	request.finishPipelineStage()
+	request.finishRequest()
+	srv.requestFinished(request)
+}
+
+func (srv *Server) writeHTTP2Response(w http.ResponseWriter, req *http.Request, res *http.Response) error {
+	header := w.Header()
+	for k, v := range res.Header {
+		header[k] = v
+	}
+	for _, k := range http2HopHeaders {
+		header.Del(k)
+	}
+	if res.ContentLength >= 0 && header.Get("Content-Length") == "" && res.StatusCode >= 200 && res.StatusCode != 204 && res.StatusCode != 304 {
+		header.Set("Content-Length", strconv.FormatInt(res.ContentLength, 10))
+	}
+	w.WriteHeader(res.StatusCode)
+	if res.Body == nil || req.Method == "HEAD" {
+		return nil
+	}
+	if res.Trailer == nil {
+		res.Trailer = make(http.Header)
+	}
+	// net/http sends these as trailers without them being announced
+	defer func() {
+		for k, v := range res.Trailer {
+			header[http.TrailerPrefix+k] = v
+		}
+	}()
+	if stream := streamFunc(res); stream != nil {
+		rc := http.NewResponseController(w)
+		sw := &StreamWriter{w: w, flush: rc.Flush, closing: srv.stopAccepting, trailer: res.Trailer}
+		if srv.WriteTimeout > 0 {
+			sw.deadline = func() {
+				rc.SetWriteDeadline(time.Now().Add(srv.WriteTimeout))
+			}
+		}
+		if err := sw.Flush(); err != nil {
+			return err
+		}
+		return stream(sw)
+	}
+	_, err := io.Copy(w, res.Body)
+	return err
+}
+
+// A connection whose first bytes have already been read into br
+type bufferedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.br.Read(b)
+}
+
+// A listener for connections accepted somewhere else
+type connListener struct {
+	conns     chan net.Conn
+	closed    chan int
+	closeOnce sync.Once
+}
+
+func newConnListener() *connListener {
+	return &connListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan int),
+	}
+}
+
+// Returns false if the listener is closed
+func (l *connListener) push(c net.Conn) bool {
+	select {
+	case l.conns <- c:
+		return true
+	case <-l.closed:
+		return false
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
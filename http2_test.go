@@ -0,0 +1,195 @@
+package falcore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func protoFilter(req *Request) *http.Response {
+	return SimpleResponse(req.HttpRequest, 200, nil, req.HttpRequest.Proto)
+}
+
+func http2Get(t *testing.T, client *http.Client, url string) (*http.Response, string) {
+	res, err := client.Get(url)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	return res, string(body)
+}
+
+func TestServerHTTP2(t *testing.T) {
+	dir := newTestCertificateDir(t)
+	defer os.RemoveAll(dir)
+
+	srv := newTestServer(t, protoFilter)
+	srv.HTTP2 = true
+	done := make(chan *Request, 10)
+	srv.Pipeline.RequestDoneCallback = NewRequestFilter(func(req *Request) *http.Response {
+		done <- req
+		return nil
+	})
+	go srv.ListenAndServeTLS(filepath.Join(dir, "a.crt"), filepath.Join(dir, "a.key"))
+	<-srv.AcceptReady
+	defer srv.Shutdown(time.Now().Add(time.Second))
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+	url := fmt.Sprintf("https://localhost:%v/", srv.Port())
+
+	// several streams at once on the same connection
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if res, body := http2Get(t, client, url); res.ProtoMajor != 2 || body != "HTTP/2.0" {
+				t.Errorf("Expected HTTP/2 got %v %q", res.Proto, body)
+			}
+		}()
+	}
+	wg.Wait()
+
+	select {
+	case req := <-done:
+		if req.PipelineStageStats.Len() < 3 {
+			t.Errorf("Expected stage stats for HTTP/2 requests, got %v", req.PipelineStageStats.Len())
+		}
+	case <-time.After(time.Second):
+		t.Errorf("RequestDoneCallback wasn't called")
+	}
+}
+
+func TestServerH2C(t *testing.T) {
+	srv := newTestServer(t, protoFilter)
+	srv.H2C = true
+	startTestServer(srv)
+	defer srv.Shutdown(time.Now().Add(time.Second))
+
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: transport}
+	if res, body := http2Get(t, client, fmt.Sprintf("http://localhost:%v/", srv.Port())); res.ProtoMajor != 2 || body != "HTTP/2.0" {
+		t.Errorf("Expected h2c got %v %q", res.Proto, body)
+	}
+
+	// HTTP/1 still works, even a request shorter than the preface
+	c, br := dialTestServer(t, srv)
+	defer c.Close()
+	if _, body := roundTrip(t, c, br, "GET / HTTP/1.0\r\n\r\n"); body != "HTTP/1.0" {
+		t.Errorf("Expected HTTP/1.0 got %q", body)
+	}
+
+	// requests with a body aren't upgraded
+	c, br = dialTestServer(t, srv)
+	defer c.Close()
+	raw := "POST / HTTP/1.1\r\nHost: test\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: AAMAAABkAAQAAP__\r\nContent-Length: 5\r\n\r\nhello"
+	if res, body := roundTrip(t, c, br, raw); res.StatusCode != 200 || body != "HTTP/1.1" {
+		t.Errorf("Expected an HTTP/1.1 answer to Upgrade: h2c with a body got %v %q", res.StatusCode, body)
+	}
+}
+
+func TestServerH2CUpgrade(t *testing.T) {
+	srv := newTestServer(t, protoFilter)
+	srv.H2C = true
+	startTestServer(srv)
+	defer srv.Shutdown(time.Now().Add(time.Second))
+
+	c, br := dialTestServer(t, srv)
+	defer c.Close()
+	io.WriteString(c, "GET / HTTP/1.1\r\nHost: test\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: AAMAAABkAAQAAP__\r\n\r\n")
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	res, err := http.ReadResponse(br, nil)
+	if err != nil || res.StatusCode != 101 || res.Header.Get("Upgrade") != "h2c" {
+		t.Fatalf("Expected 101 Switching Protocols: %v %v", res, err)
+	}
+	// the preface and an empty SETTINGS frame
+	c.Write(append(append([]byte{}, http2Preface...), 0, 0, 0, http2FrameSettings, 0, 0, 0, 0, 0))
+	if body := readHTTP2Data(t, br, 1); body != "HTTP/2.0" {
+		t.Errorf("Expected the upgraded request to be answered on stream 1 got %q", body)
+	}
+}
+
+// Reads frames until the end of stream's body and returns the body
+func readHTTP2Data(t *testing.T, br *bufio.Reader, stream uint32) string {
+	var body []byte
+	for {
+		head := make([]byte, http2FrameHeaderLen)
+		if _, err := io.ReadFull(br, head); err != nil {
+			t.Fatalf("Reading frame failed: %v", err)
+		}
+		payload := make([]byte, int(head[0])<<16|int(head[1])<<8|int(head[2]))
+		if _, err := io.ReadFull(br, payload); err != nil {
+			t.Fatalf("Reading frame failed: %v", err)
+		}
+		// DATA
+		if head[3] == 0 && binary.BigEndian.Uint32(head[5:])&0x7FFFFFFF == stream {
+			body = append(body, payload...)
+			if head[4]&http2FlagEndStream != 0 {
+				return string(body)
+			}
+		}
+	}
+}
+
+func TestServerHTTP2Stream(t *testing.T) {
+	release := make(chan int)
+	srv := newTestServer(t, func(req *Request) *http.Response {
+		return StreamResponse(req.HttpRequest, 200, nil, func(w *StreamWriter) error {
+			w.Write([]byte("first "))
+			w.Flush()
+			<-release
+			w.Write([]byte("second"))
+			return nil
+		})
+	})
+	srv.H2C = true
+	startTestServer(srv)
+	defer srv.Shutdown(time.Now().Add(time.Second))
+
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	res, err := (&http.Client{Transport: transport}).Get(fmt.Sprintf("http://localhost:%v/", srv.Port()))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer res.Body.Close()
+	first := make([]byte, 6)
+	if _, err := io.ReadFull(res.Body, first); err != nil || string(first) != "first " {
+		t.Errorf("Expected the flushed part: %q %v", first, err)
+	}
+	close(release)
+	if rest, _ := ioutil.ReadAll(res.Body); string(rest) != "second" {
+		t.Errorf("Expected the rest of the stream: %q", rest)
+	}
+}
+
+func TestH2CHeadersFrames(t *testing.T) {
+	// RFC 7541 C.1.3
+	if b := hpackInt(nil, 5, 1337); !bytes.Equal(b, []byte{31, 154, 10}) {
+		t.Errorf("Bad HPACK integer %v", b)
+	}
+	frames := h2cHeadersFrames(make([]byte, http2DefaultMaxFrameSize+10))
+	if len(frames) != 2*http2FrameHeaderLen+http2DefaultMaxFrameSize+10 {
+		t.Fatalf("Expected two frames got %v bytes", len(frames))
+	}
+	second := frames[http2FrameHeaderLen+http2DefaultMaxFrameSize:]
+	if frames[3] != http2FrameHeaders || frames[4] != http2FlagEndStream ||
+		second[3] != http2FrameContinuation || second[4] != http2FlagEndHeaders || second[2] != 10 {
+		t.Errorf("Expected HEADERS then CONTINUATION got %v %v", frames[:http2FrameHeaderLen], second[:http2FrameHeaderLen])
+	}
+}
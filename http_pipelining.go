@@ -0,0 +1,156 @@
+package falcore
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Reads the requests a pipelining client has already sent after first,
+// up to MaxPipelinedRequests.  Reading stops after a request that can't
+// run ahead, which is returned last.  An error reading one stops the batch
+// and is returned along with it.
+func (srv *Server) readPipelined(c net.Conn, bpe *bufferPoolEntry, first *connRequest, reqCount int) (batch []*connRequest, err error) {
+	batch = []*connRequest{first}
+	for len(batch) < srv.MaxPipelinedRequests && batch[len(batch)-1].runAhead() && requestBuffered(bpe.br) {
+		if srv.stopping() || (srv.MaxRequestsPerConn > 0 && reqCount+len(batch) > srv.MaxRequestsPerConn) {
+			break
+		}
+		var req *http.Request
+		if req, err = srv.readRequest(bpe); err != nil {
+			return
+		}
+		srv.countConnRequest(c)
+		batch = append(batch, srv.newConnRequest(c, req, time.Now()))
+	}
+	return
+}
+
+// Whether the request can run while the responses before it are written
+// and the requests after it are read.  Only safe methods do, anything else
+// could depend on what the requests before it changed.  Bodies and
+// upgrades need the connection to themselves.
+func (cr *connRequest) runAhead() bool {
+	req := cr.req
+	return safeMethod(req.Method) && cr.noBody && !req.Close && req.Header.Get("Upgrade") == "" && !expectsContinue(req)
+}
+
+// RFC 7231 4.2.1
+func safeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+	return false
+}
+
+// Whether the headers of another request are already buffered so reading
+// it won't block
+func requestBuffered(br *bufio.Reader) bool {
+	b, _ := br.Peek(br.Buffered())
+	return bytes.Contains(b, []byte("\n\r\n")) || bytes.Contains(b, []byte("\n\n"))
+}
+
+// Runs the batch through the pipeline concurrently and writes the
+// responses in order.  A last request that can't run ahead waits for the
+// ones before it to be answered.  err is from reading the request after
+// the batch.  Returns whether the connection can be kept alive.
+func (srv *Server) servePipelined(c net.Conn, br *bufio.Reader, batch []*connRequest, reqCount int, err error) bool {
+	defer func() {
+		// the requests' contexts would outlive a panic
+		for _, cr := range batch {
+			cr.cancel(nil)
+		}
+	}()
+	srv.countPipelined(len(batch))
+	last := len(batch) - 1
+	for i, cr := range batch {
+		if i < last || cr.runAhead() {
+			cr.done = make(chan int)
+			go srv.executeAhead(cr)
+		}
+	}
+	var watcher *disconnectWatcher
+	if batch[last].done != nil {
+		// every request has been read so the client going away
+		// cancels all of them
+		watcher = srv.newDisconnectWatcher(c, br, func(cause error) {
+			for _, cr := range batch {
+				cr.cancel(cause)
+			}
+		})
+		watcher.start()
+	}
+
+	keepAlive := true
+	for i, cr := range batch {
+		if !keepAlive {
+			// an earlier response closed the connection
+			cr.cancel(nil)
+			if cr.done != nil {
+				srv.dropConnRequest(cr)
+			}
+			continue
+		}
+		if cr.done != nil {
+			<-cr.done
+			if upgradeHandler(cr.res) != nil {
+				// the connection can't be handed over with requests
+				// still waiting for their responses
+				cr.res.Body.Close()
+				cr.res = SimpleResponse(cr.req, 400, nil, "Upgrade isn't supported on pipelined requests\n")
+			}
+		} else {
+			srv.executeConnRequest(c, br, cr)
+		}
+		keepAlive = srv.finishConnRequest(c, br, cr, !cr.req.Close, reqCount+i)
+	}
+	if watcher != nil {
+		watcher.stop()
+	}
+	if err != nil {
+		if keepAlive {
+			srv.requestReadFailed(c, err)
+		}
+		return false
+	}
+	return keepAlive
+}
+
+// Runs a request ahead of the responses before it
+func (srv *Server) executeAhead(cr *connRequest) {
+	defer close(cr.done)
+	srv.initStage(cr.request)
+	if res := protect(cr.request, func() { cr.res = srv.execute(cr.request) }); res != nil {
+		cr.res = res
+	}
+}
+
+// Finishes a request that ran ahead but can't be answered because an
+// earlier response closed the connection.  It gets a skipped
+// server.ResponseWrite stage and is otherwise done like one that was.
+func (srv *Server) dropConnRequest(cr *connRequest) {
+	<-cr.done
+	request := cr.request
+	request.startPipelineStage("server.ResponseWrite")
+	request.CurrentStage.Status = StatusSkip
+	cr.req.Body.Close()
+	if cr.res.Body != nil {
+		cr.res.Body.Close()
+	}
+	request.finishPipelineStage()
+	request.finishRequest()
+	srv.requestFinished(request)
+}
+
+func (srv *Server) countPipelined(depth int) {
+	srv.stats.pipelinedRequests.Add(uint64(depth - 1))
+	for {
+		max := srv.stats.maxPipelineDepth.Load()
+		if int64(depth) <= max || srv.stats.maxPipelineDepth.CompareAndSwap(max, int64(depth)) {
+			return
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package falcore
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// /slow can't finish until /fast has started, which only happens if they
+// run at once
+func pipeliningFilter(fastStarted chan int) func(req *Request) *http.Response {
+	return func(req *Request) *http.Response {
+		switch req.HttpRequest.URL.Path {
+		case "/slow":
+			select {
+			case <-fastStarted:
+				return SimpleResponse(req.HttpRequest, 200, nil, "slow")
+			case <-time.After(2 * time.Second):
+				return SimpleResponse(req.HttpRequest, 200, nil, "slow timed out")
+			}
+		case "/fast":
+			close(fastStarted)
+			return SimpleResponse(req.HttpRequest, 200, nil, "fast")
+		case "/close":
+			res := SimpleResponse(req.HttpRequest, 200, nil, "close")
+			res.Close = true
+			return res
+		case "/echo":
+			body, _ := ioutil.ReadAll(req.HttpRequest.Body)
+			return SimpleResponse(req.HttpRequest, 200, nil, string(body))
+		}
+		return SimpleResponse(req.HttpRequest, 200, nil, req.HttpRequest.URL.Path)
+	}
+}
+
+func TestServerPipelining(t *testing.T) {
+	srv := newTestServer(t, pipeliningFilter(make(chan int)))
+	srv.MaxPipelinedRequests = 4
+	startTestServer(srv)
+	defer srv.Shutdown(time.Now().Add(time.Second))
+
+	c, br := dialTestServer(t, srv)
+	defer c.Close()
+	// the body request waits for the ones before it and ends the batch
+	io.WriteString(c, "GET /slow HTTP/1.1\r\nHost: test\r\n\r\n"+
+		"GET /fast HTTP/1.1\r\nHost: test\r\n\r\n"+
+		"POST /echo HTTP/1.1\r\nHost: test\r\nContent-Length: 4\r\n\r\nbody"+
+		"GET /after HTTP/1.1\r\nHost: test\r\n\r\n")
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, expected := range []string{"slow", "fast", "body", "/after"} {
+		res, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("Read response failed: %v", err)
+		}
+		if body, _ := ioutil.ReadAll(res.Body); string(body) != expected {
+			t.Errorf("Expected %q got %q", expected, body)
+		}
+	}
+	if stats := srv.Stats(); stats.PipelinedRequests != 2 || stats.MaxPipelineDepth != 3 {
+		t.Errorf("Expected the pipelined requests to be counted: %+v", stats)
+	}
+}
+
+func TestServerPipeliningUnsafe(t *testing.T) {
+	srv := newTestServer(t, pipeliningFilter(make(chan int)))
+	srv.MaxPipelinedRequests = 4
+	startTestServer(srv)
+	defer srv.Shutdown(time.Now().Add(time.Second))
+
+	c, br := dialTestServer(t, srv)
+	defer c.Close()
+	// the DELETE doesn't start until /slow has given up waiting for it
+	io.WriteString(c, "GET /slow HTTP/1.1\r\nHost: test\r\n\r\n"+
+		"DELETE /fast HTTP/1.1\r\nHost: test\r\n\r\n")
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, expected := range []string{"slow timed out", "fast"} {
+		res, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("Read response failed: %v", err)
+		}
+		if body, _ := ioutil.ReadAll(res.Body); string(body) != expected {
+			t.Errorf("Expected %q got %q", expected, body)
+		}
+	}
+}
+
+func TestServerPipeliningClose(t *testing.T) {
+	srv := newTestServer(t, pipeliningFilter(make(chan int)))
+	srv.MaxPipelinedRequests = 4
+	srv.MaxRequestsPerConn = 2
+	startTestServer(srv)
+	defer srv.Shutdown(time.Now().Add(time.Second))
+
+	c, br := dialTestServer(t, srv)
+	defer c.Close()
+	io.WriteString(c, "GET /1 HTTP/1.1\r\nHost: test\r\n\r\n"+
+		"GET /2 HTTP/1.1\r\nHost: test\r\n\r\n"+
+		"GET /3 HTTP/1.1\r\nHost: test\r\n\r\n")
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, expected := range []string{"/1", "/2"} {
+		res, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("Read response failed: %v", err)
+		}
+		if body, _ := ioutil.ReadAll(res.Body); string(body) != expected {
+			t.Errorf("Expected %q got %q", expected, body)
+		}
+		if expected == "/2" && !res.Close {
+			t.Errorf("Expected the last response to close the connection")
+		}
+	}
+	if !connClosed(c, br) {
+		t.Errorf("Expected the connection to be closed")
+	}
+}
+
+func TestServerPipeliningDropped(t *testing.T) {
+	srv := newTestServer(t, pipeliningFilter(make(chan int)))
+	srv.MaxPipelinedRequests = 4
+	done := make(chan *Request, 3)
+	srv.Pipeline.RequestDoneCallback = NewRequestFilter(func(req *Request) *http.Response {
+		done <- req
+		return nil
+	})
+	startTestServer(srv)
+	defer srv.Shutdown(time.Now().Add(time.Second))
+
+	c, br := dialTestServer(t, srv)
+	defer c.Close()
+	io.WriteString(c, "GET /close HTTP/1.1\r\nHost: test\r\n\r\n"+
+		"GET /2 HTTP/1.1\r\nHost: test\r\n\r\n"+
+		"GET /3 HTTP/1.1\r\nHost: test\r\n\r\n")
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if res, err := http.ReadResponse(br, nil); err != nil || !res.Close {
+		t.Fatalf("Expected the first response to close the connection: %v", err)
+	}
+	// the requests behind it still finish, with nothing written
+	for i := 0; i < 3; i++ {
+		select {
+		case req := <-done:
+			pss := req.PipelineStageStats.Back().Value.(*PipelineStageStat)
+			path := req.HttpRequest.URL.Path
+			if path != "/close" && (pss.Name != "server.ResponseWrite" || pss.Status != StatusSkip) {
+				t.Errorf("%v: Expected a skipped response write got %v", path, pss)
+			}
+			if req.EndTime.IsZero() {
+				t.Errorf("%v: Expected the request to be finished", path)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("RequestDoneCallback wasn't called for every request")
+		}
+	}
+}
+
+func TestServerPipeliningDisabled(t *testing.T) {
+	srv := newTestServer(t, pipeliningFilter(make(chan int)))
+	startTestServer(srv)
+	defer srv.Shutdown(time.Now().Add(time.Second))
+
+	c, br := dialTestServer(t, srv)
+	defer c.Close()
+	io.WriteString(c, "GET /slow HTTP/1.1\r\nHost: test\r\n\r\nGET /fast HTTP/1.1\r\nHost: test\r\n\r\n")
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, expected := range []string{"slow timed out", "fast"} {
+		res, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("Read response failed: %v", err)
+		}
+		if body, _ := ioutil.ReadAll(res.Body); string(body) != expected {
+			t.Errorf("Expected %q got %q", expected, body)
+		}
+	}
+	if stats := srv.Stats(); stats.PipelinedRequests != 0 {
+		t.Errorf("Expected no pipelining: %+v", stats)
+	}
+}
@@ -0,0 +1,241 @@
+package falcore
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// What the Server does with a connection or request over MaxConnections
+// or MaxConcurrentRequests
+type OverloadPolicy int
+
+const (
+	// Answer 503 Service Unavailable with a Retry-After header right away
+	OverloadReject OverloadPolicy = iota
+	// Wait up to OverloadQueueTimeout for a slot to free up, then reject
+	OverloadQueue
+	// Stop accepting connections until one closes.  New connections wait
+	// in the listen backlog.  Requests wait for a slot for as long as it
+	// takes, which holds up reading from their connection.
+	OverloadStopAccepting
+)
+
+// How long a shed connection gets to send its request and read the 503
+const shedTimeout = time.Second
+
+// Counters for monitoring a Server.  See Server.Stats.
+type ServerStats struct {
+	// Open connections, including queued ones
+	Connections int
+	// Requests running through the Pipeline
+	ActiveRequests int64
+	// Connections waiting for a slot under MaxConnections
+	QueuedConnections int64
+	// Requests waiting for a slot under MaxConcurrentRequests
+	QueuedRequests int64
+	// Connections turned away since the Server started
+	ShedConnections uint64
+	// Requests turned away since the Server started
+	ShedRequests uint64
+	// Panics recovered since the Server started
+	Panics uint64
+	// Requests rejected for being over MaxHeaderBytes, MaxHeaderCount and
+	// MaxURILength since the Server started
+	HeaderTooLarge uint64
+	TooManyHeaders uint64
+	URITooLong     uint64
+	// Requests with bodies over MaxBodyBytes or a BodyLimitFilter's limit
+	// since the Server started
+	BodyTooLarge uint64
+	// Errors from Accept since the Server started, not counting the
+	// listener being closed by StopAccepting
+	AcceptErrors uint64
+	// Idle connections closed to free up file descriptors when Accept
+	// ran out of them
+	FdExhaustedCloses uint64
+	// Requests run ahead of the response to an earlier pipelined request
+	// since the Server started.  See MaxPipelinedRequests.
+	PipelinedRequests uint64
+	// The most requests from one connection run at once
+	MaxPipelineDepth int64
+}
+
+type serverStats struct {
+	activeRequests atomic.Int64
+	queuedConns    atomic.Int64
+	queuedRequests atomic.Int64
+	shedConns      atomic.Uint64
+	shedRequests   atomic.Uint64
+	panics         atomic.Uint64
+	headerTooLarge atomic.Uint64
+	tooManyHeaders atomic.Uint64
+	uriTooLong     atomic.Uint64
+	bodyTooLarge   atomic.Uint64
+
+	acceptErrors      atomic.Uint64
+	fdExhaustedCloses atomic.Uint64
+	pipelinedRequests atomic.Uint64
+	maxPipelineDepth  atomic.Int64
+}
+
+// A snapshot of the Server's counters
+func (srv *Server) Stats() ServerStats {
+	srv.connMutex.Lock()
+	conns := len(srv.conns)
+	srv.connMutex.Unlock()
+	return ServerStats{
+		Connections:       conns,
+		ActiveRequests:    srv.stats.activeRequests.Load(),
+		QueuedConnections: srv.stats.queuedConns.Load(),
+		QueuedRequests:    srv.stats.queuedRequests.Load(),
+		ShedConnections:   srv.stats.shedConns.Load(),
+		ShedRequests:      srv.stats.shedRequests.Load(),
+		Panics:            srv.stats.panics.Load(),
+		HeaderTooLarge:    srv.stats.headerTooLarge.Load(),
+		TooManyHeaders:    srv.stats.tooManyHeaders.Load(),
+		URITooLong:        srv.stats.uriTooLong.Load(),
+		BodyTooLarge:      srv.stats.bodyTooLarge.Load(),
+		AcceptErrors:      srv.stats.acceptErrors.Load(),
+		FdExhaustedCloses: srv.stats.fdExhaustedCloses.Load(),
+		PipelinedRequests: srv.stats.pipelinedRequests.Load(),
+		MaxPipelineDepth:  srv.stats.maxPipelineDepth.Load(),
+	}
+}
+
+func (srv *Server) prepareLimits() {
+	if srv.MaxConnections > 0 {
+		srv.connSlots = make(chan int, srv.MaxConnections)
+	}
+	if srv.MaxConcurrentRequests > 0 {
+		srv.requestSlots = make(chan int, srv.MaxConcurrentRequests)
+	}
+}
+
+// Takes a slot, waiting as long as the OverloadPolicy allows.  Closing
+// stop or done gives up waiting.
+func (srv *Server) acquireSlot(slots chan int, queued *atomic.Int64, stop <-chan int, done <-chan struct{}) bool {
+	select {
+	case slots <- 1:
+		return true
+	default:
+	}
+	if srv.OverloadPolicy == OverloadReject {
+		return false
+	}
+	var timeout <-chan time.Time
+	if srv.OverloadPolicy == OverloadQueue && srv.OverloadQueueTimeout > 0 {
+		timer := time.NewTimer(srv.OverloadQueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	queued.Add(1)
+	defer queued.Add(-1)
+	select {
+	case slots <- 1:
+		return true
+	case <-timeout:
+	case <-stop:
+	case <-done:
+	}
+	return false
+}
+
+func releaseSlot(slots chan int) {
+	<-slots
+}
+
+// With OverloadStopAccepting the accept loop holds on to each new
+// connection until it has a slot, leaving the rest in the listen backlog.
+// Not ok if the Server stopped while waiting.
+func (srv *Server) acceptSlot() (acquired, ok bool) {
+	if srv.connSlots == nil || srv.OverloadPolicy != OverloadStopAccepting {
+		return false, true
+	}
+	ok = srv.acquireSlot(srv.connSlots, &srv.stats.queuedConns, srv.stopAccepting, nil)
+	return ok, ok
+}
+
+// Serves the connection once it has a slot under MaxConnections.  The
+// accept loop has already taken the slot if acquired is set.
+func (srv *Server) serveConn(c net.Conn, acquired bool) {
+	// here rather than in trackConn so ConnState doesn't hold up accepting
+	srv.connStateChanged(c, ConnNew, 0)
+	if srv.connSlots != nil {
+		if !acquired && !srv.acquireSlot(srv.connSlots, &srv.stats.queuedConns, srv.stopAccepting, nil) {
+			srv.shedConn(c)
+			return
+		}
+		defer releaseSlot(srv.connSlots)
+	}
+	srv.handler(c)
+}
+
+// Answers the connection's first request with a 503 and closes it
+func (srv *Server) shedConn(c net.Conn) {
+	defer srv.connectionFinished(c)
+	srv.stats.shedConns.Add(1)
+	Debug("%s SERVER Shedding connection from %v", srv.serverLogPrefix(), c.RemoteAddr())
+	c.SetDeadline(time.Now().Add(shedTimeout))
+	// closing with the request unread can reset the connection before
+	// the client sees the response
+	req, _ := http.ReadRequest(bufio.NewReader(c))
+	res := srv.overloadResponse(req)
+	res.Close = true
+	wbuf := bufio.NewWriter(c)
+	if res.Write(wbuf) == nil {
+		wbuf.Flush()
+	}
+}
+
+// Runs the request through the Pipeline once it's passed MaxBodyBytes
+// and ExpectContinue and has a slot under MaxConcurrentRequests.
+// "OPTIONS *" is answered by GlobalOptions instead.  Shed
+// requests get a 503 and a server.Overload stage with the fail status.
+func (srv *Server) execute(request *Request) *http.Response {
+	req := request.HttpRequest
+	if srv.MaxBodyBytes > 0 && !request.limitBody(srv.MaxBodyBytes) {
+		request.startPipelineStage("server.MaxBodyBytes")
+		request.CurrentStage.Status = StatusFail
+		request.finishPipelineStage()
+		return bodyTooLargeResponse(req)
+	}
+	if srv.ExpectContinue != nil && expectsContinue(req) {
+		if res := srv.checkExpectContinue(request); res != nil {
+			return res
+		}
+	}
+	if isGlobalOptions(req) {
+		return srv.globalOptions(request)
+	}
+	if srv.requestSlots != nil {
+		if !srv.acquireSlot(srv.requestSlots, &srv.stats.queuedRequests, nil, req.Context().Done()) {
+			srv.stats.shedRequests.Add(1)
+			request.startPipelineStage("server.Overload")
+			request.CurrentStage.Status = StatusFail
+			request.finishPipelineStage()
+			return srv.overloadResponse(req)
+		}
+		defer releaseSlot(srv.requestSlots)
+	}
+	srv.stats.activeRequests.Add(1)
+	defer srv.stats.activeRequests.Add(-1)
+	res := srv.Pipeline.execute(request)
+	if res == nil {
+		res = SimpleResponse(req, 404, nil, "Not Found")
+	}
+	return res
+}
+
+func (srv *Server) overloadResponse(req *http.Request) *http.Response {
+	retry := srv.OverloadRetryAfter
+	if retry <= 0 {
+		retry = time.Second
+	}
+	res := SimpleResponse(req, 503, nil, "Service Unavailable\n")
+	res.Header.Set("Retry-After", strconv.Itoa(int((retry+time.Second-1)/time.Second)))
+	return res
+}
@@ -0,0 +1,183 @@
+package falcore
+
+import (
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Blocks every request until release is closed
+func newLimitTestServer(t *testing.T, release chan int) (*Server, chan int) {
+	started := make(chan int, 10)
+	srv := newTestServer(t, func(req *Request) *http.Response {
+		started <- 1
+		<-release
+		return SimpleResponse(req.HttpRequest, 200, nil, "hello")
+	})
+	return srv, started
+}
+
+func waitForStats(t *testing.T, srv *Server, ok func(ServerStats) bool) ServerStats {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		stats := srv.Stats()
+		if ok(stats) || time.Now().After(deadline) {
+			return stats
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMaxConcurrentRequestsReject(t *testing.T) {
+	release := make(chan int)
+	srv, started := newLimitTestServer(t, release)
+	srv.MaxConcurrentRequests = 1
+	srv.OverloadRetryAfter = 1500 * time.Millisecond
+	startTestServer(srv)
+	defer srv.Shutdown(time.Now().Add(time.Second))
+
+	c1, br1 := dialTestServer(t, srv)
+	defer c1.Close()
+	io.WriteString(c1, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+	<-started
+
+	c2, br2 := dialTestServer(t, srv)
+	defer c2.Close()
+	res, _ := roundTrip(t, c2, br2, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+	if res.StatusCode != 503 || res.Header.Get("Retry-After") != "2" {
+		t.Errorf("Expected 503 with Retry-After: 2 got %v %q", res.StatusCode, res.Header.Get("Retry-After"))
+	}
+	if stats := srv.Stats(); stats.ShedRequests != 1 || stats.ActiveRequests != 1 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+
+	close(release)
+	if res, _ := roundTrip(t, c1, br1, ""); res.StatusCode != 200 {
+		t.Errorf("Expected the first request to finish got %v", res.StatusCode)
+	}
+	// the shed request's connection is still usable
+	if res, _ := roundTrip(t, c2, br2, "GET / HTTP/1.1\r\nHost: test\r\n\r\n"); res.StatusCode != 200 {
+		t.Errorf("Expected 200 after the overload got %v", res.StatusCode)
+	}
+}
+
+func TestMaxConcurrentRequestsQueue(t *testing.T) {
+	release := make(chan int)
+	srv, started := newLimitTestServer(t, release)
+	srv.MaxConcurrentRequests = 1
+	srv.OverloadPolicy = OverloadQueue
+	srv.OverloadQueueTimeout = 5 * time.Second
+	startTestServer(srv)
+	defer srv.Shutdown(time.Now().Add(time.Second))
+
+	c1, br1 := dialTestServer(t, srv)
+	defer c1.Close()
+	io.WriteString(c1, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+	<-started
+
+	c2, br2 := dialTestServer(t, srv)
+	defer c2.Close()
+	io.WriteString(c2, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+	if stats := waitForStats(t, srv, func(s ServerStats) bool { return s.QueuedRequests == 1 }); stats.QueuedRequests != 1 {
+		t.Errorf("Expected a queued request: %+v", stats)
+	}
+
+	close(release)
+	if res, _ := roundTrip(t, c1, br1, ""); res.StatusCode != 200 {
+		t.Errorf("Expected the first request to finish got %v", res.StatusCode)
+	}
+	if res, _ := roundTrip(t, c2, br2, ""); res.StatusCode != 200 {
+		t.Errorf("Expected the queued request to finish got %v", res.StatusCode)
+	}
+	if stats := srv.Stats(); stats.ShedRequests != 0 || stats.QueuedRequests != 0 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestMaxConcurrentRequestsQueueTimeout(t *testing.T) {
+	release := make(chan int)
+	srv, started := newLimitTestServer(t, release)
+	defer close(release)
+	srv.MaxConcurrentRequests = 1
+	srv.OverloadPolicy = OverloadQueue
+	srv.OverloadQueueTimeout = 50 * time.Millisecond
+	startTestServer(srv)
+	defer srv.Shutdown(time.Now().Add(time.Second))
+
+	c1, _ := dialTestServer(t, srv)
+	defer c1.Close()
+	io.WriteString(c1, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+	<-started
+
+	c2, br2 := dialTestServer(t, srv)
+	defer c2.Close()
+	if res, _ := roundTrip(t, c2, br2, "GET / HTTP/1.1\r\nHost: test\r\n\r\n"); res.StatusCode != 503 {
+		t.Errorf("Expected 503 after the queue timeout got %v", res.StatusCode)
+	}
+	if stats := srv.Stats(); stats.ShedRequests != 1 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestMaxConnectionsReject(t *testing.T) {
+	srv := newTestServer(t, helloFilter)
+	srv.MaxConnections = 1
+	startTestServer(srv)
+	defer srv.Shutdown(time.Now().Add(time.Second))
+
+	c1, br1 := dialTestServer(t, srv)
+	defer c1.Close()
+	roundTrip(t, c1, br1, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+
+	c2, br2 := dialTestServer(t, srv)
+	defer c2.Close()
+	res, _ := roundTrip(t, c2, br2, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+	if res.StatusCode != 503 || res.Header.Get("Retry-After") != "1" {
+		t.Errorf("Expected 503 with Retry-After: 1 got %v %q", res.StatusCode, res.Header.Get("Retry-After"))
+	}
+	if !connClosed(c2, br2) {
+		t.Errorf("Expected the shed connection to be closed")
+	}
+	if stats := srv.Stats(); stats.ShedConnections != 1 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+
+	// the slot frees up when the first connection closes
+	c1.Close()
+	waitForStats(t, srv, func(s ServerStats) bool { return s.Connections == 0 })
+	c3, br3 := dialTestServer(t, srv)
+	defer c3.Close()
+	if res, _ := roundTrip(t, c3, br3, "GET / HTTP/1.1\r\nHost: test\r\n\r\n"); res.StatusCode != 200 {
+		t.Errorf("Expected 200 once there was room got %v", res.StatusCode)
+	}
+}
+
+func TestMaxConnectionsStopAccepting(t *testing.T) {
+	srv := newTestServer(t, helloFilter)
+	srv.MaxConnections = 1
+	srv.OverloadPolicy = OverloadStopAccepting
+	startTestServer(srv)
+	defer srv.Shutdown(time.Now().Add(time.Second))
+
+	c1, br1 := dialTestServer(t, srv)
+	defer c1.Close()
+	roundTrip(t, c1, br1, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+
+	// connects through the backlog but isn't served yet
+	c2, br2 := dialTestServer(t, srv)
+	defer c2.Close()
+	io.WriteString(c2, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+	c2.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := br2.Peek(1); err == nil {
+		t.Fatalf("Expected the second connection to wait")
+	}
+
+	c1.Close()
+	if res, _ := roundTrip(t, c2, br2, ""); res.StatusCode != 200 {
+		t.Errorf("Expected 200 once there was room got %v", res.StatusCode)
+	}
+	if stats := srv.Stats(); stats.ShedConnections != 0 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
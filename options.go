@@ -0,0 +1,28 @@
+package falcore
+
+import (
+	"net/http"
+)
+
+// Whether the request is "OPTIONS *", which asks about the server as a
+// whole rather than any resource.  See RFC 7231 section 4.3.7.
+func isGlobalOptions(req *http.Request) bool {
+	return req.Method == "OPTIONS" && req.RequestURI == "*"
+}
+
+// Answers "OPTIONS *" with the Server's GlobalOptions filter or an empty
+// 200 if there isn't one
+func (srv *Server) globalOptions(request *Request) *http.Response {
+	request.startPipelineStage("server.GlobalOptions")
+	defer request.finishPipelineStage()
+	var res *http.Response
+	if srv.GlobalOptions != nil {
+		if pres := protect(request, func() { res = srv.GlobalOptions.FilterRequest(request) }); pres != nil {
+			res = pres
+		}
+	}
+	if res == nil {
+		res = SimpleResponse(request.HttpRequest, 200, nil, "")
+	}
+	return res
+}
@@ -0,0 +1,98 @@
+package falcore
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Sends a HEAD request and reads the response as a client would
+func headRoundTrip(t *testing.T, srv *Server, raw string) *http.Response {
+	c, br := dialTestServer(t, srv)
+	defer c.Close()
+	io.WriteString(c, raw)
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	head, _ := http.NewRequest("HEAD", "/", nil)
+	res, err := http.ReadResponse(br, head)
+	if err != nil {
+		t.Fatalf("Read response failed: %v", err)
+	}
+	// nothing should follow the headers
+	if res, _ := roundTrip(t, c, br, "GET / HTTP/1.1\r\nHost: test\r\n\r\n"); res.StatusCode != 200 {
+		t.Errorf("Expected the next request on the connection to work got %v", res.StatusCode)
+	}
+	return res
+}
+
+func TestServerHEAD(t *testing.T) {
+	srv := newTestServer(t, func(req *Request) *http.Response {
+		switch req.HttpRequest.URL.Path {
+		case "/chunked":
+			return &http.Response{StatusCode: 200, ProtoMajor: 1, ProtoMinor: 1, ContentLength: -1,
+				Header: make(http.Header), Body: io.NopCloser(strings.NewReader("hello"))}
+		case "/norequest":
+			// filters don't always set Request
+			return &http.Response{StatusCode: 200, ProtoMajor: 1, ProtoMinor: 1, ContentLength: 5,
+				Header: make(http.Header), Body: io.NopCloser(strings.NewReader("hello"))}
+		}
+		return SimpleResponse(req.HttpRequest, 200, nil, "hello")
+	})
+	startTestServer(srv)
+	defer srv.Shutdown(time.Now().Add(time.Second))
+
+	if res := headRoundTrip(t, srv, "HEAD / HTTP/1.1\r\nHost: test\r\n\r\n"); res.ContentLength != 5 {
+		t.Errorf("Expected the GET Content-Length got %v", res.ContentLength)
+	}
+	if res := headRoundTrip(t, srv, "HEAD /norequest HTTP/1.1\r\nHost: test\r\n\r\n"); res.ContentLength != 5 {
+		t.Errorf("Expected the GET Content-Length got %v", res.ContentLength)
+	}
+	if res := headRoundTrip(t, srv, "HEAD /chunked HTTP/1.1\r\nHost: test\r\n\r\n"); len(res.TransferEncoding) == 0 || res.TransferEncoding[0] != "chunked" {
+		t.Errorf("Expected the GET Transfer-Encoding got %v", res.TransferEncoding)
+	}
+	// no need to close to delimit a body that isn't there
+	if res := headRoundTrip(t, srv, "HEAD /chunked HTTP/1.0\r\nConnection: keep-alive\r\n\r\n"); res.Close {
+		t.Errorf("Expected the HTTP/1.0 connection to be kept alive")
+	}
+}
+
+func TestServerGlobalOptions(t *testing.T) {
+	pipelined := make(chan string, 10)
+	newServer := func(options RequestFilter) *Server {
+		srv := newTestServer(t, func(req *Request) *http.Response {
+			pipelined <- req.HttpRequest.RequestURI
+			return SimpleResponse(req.HttpRequest, 404, nil, "")
+		})
+		srv.GlobalOptions = options
+		startTestServer(srv)
+		return srv
+	}
+
+	srv := newServer(nil)
+	defer srv.Shutdown(time.Now().Add(time.Second))
+	c, br := dialTestServer(t, srv)
+	defer c.Close()
+	if res, body := roundTrip(t, c, br, "OPTIONS * HTTP/1.1\r\nHost: test\r\n\r\n"); res.StatusCode != 200 || res.ContentLength != 0 || body != "" {
+		t.Errorf("Expected an empty 200 got %v %v %q", res.StatusCode, res.ContentLength, body)
+	}
+	// OPTIONS on a path is up to the pipeline
+	if res, _ := roundTrip(t, c, br, "OPTIONS / HTTP/1.1\r\nHost: test\r\n\r\n"); res.StatusCode != 404 {
+		t.Errorf("Expected OPTIONS / to go through the pipeline got %v", res.StatusCode)
+	}
+	if uri := <-pipelined; uri != "/" {
+		t.Errorf("OPTIONS * went through the pipeline")
+	}
+
+	srv = newServer(NewRequestFilter(func(req *Request) *http.Response {
+		res := SimpleResponse(req.HttpRequest, 200, nil, "")
+		res.Header.Set("Allow", "GET, HEAD, OPTIONS")
+		return res
+	}))
+	defer srv.Shutdown(time.Now().Add(time.Second))
+	c, br = dialTestServer(t, srv)
+	defer c.Close()
+	if res, _ := roundTrip(t, c, br, "OPTIONS * HTTP/1.1\r\nHost: test\r\n\r\n"); res.Header.Get("Allow") != "GET, HEAD, OPTIONS" {
+		t.Errorf("Expected the GlobalOptions response got %v", res.Header)
+	}
+}
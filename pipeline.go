@@ -20,11 +20,19 @@ import (
 // the FilterRequest method for inspection.  Changes to the request
 // will have no effect and the return value is ignored.
 //
+// ErrorFilters can be put in the Upstream list or returned from a Router
+// like RequestFilters.  An error they return is rendered by the
+// ErrorRenderer, or RenderErrorText if it's nil.  See ErrorFilter.
 //
+// A filter or router that panics fails its stage and the request gets
+// the Server's PanicFilter response or a 500 instead, which still goes
+// through the ResponseFilters.  A ResponseFilter that panics has its
+// response replaced the same way.
 type Pipeline struct {
 	Upstream            *list.List
 	Downstream          *list.List
 	RequestDoneCallback RequestFilter
+	ErrorRenderer       ErrorRenderer
 }
 
 func NewPipeline() (l *Pipeline) {
@@ -47,15 +55,18 @@ func (p *Pipeline) execute(req *Request) (res *http.Response) {
 		case Router:
 			t := reflect.TypeOf(filter)
 			req.startPipelineStage(t.String())
-			pipe := filter.SelectPipeline(req)
+			var pipe RequestFilter
+			res = protect(req, func() {
+				pipe = filter.SelectPipeline(req)
+			})
 			req.finishPipelineStage()
-			if pipe != nil {
+			if res == nil && pipe != nil {
 				res = p.execFilter(req, pipe)
 				if res != nil {
 					break
 				}
 			}
-		case RequestFilter:
+		case ErrorFilter, RequestFilter:
 			res = p.execFilter(req, filter)
 			if res != nil {
 				break
@@ -71,29 +82,49 @@ func (p *Pipeline) execute(req *Request) (res *http.Response) {
 		res = SimpleResponse(req.HttpRequest, 404, nil, "Not found\n")
 	}
 
-	p.down(req, res)
-	return
+	return p.down(req, res)
 }
 
-func (p *Pipeline) execFilter(req *Request, filter RequestFilter) *http.Response {
+// filter is a RequestFilter or an ErrorFilter
+func (p *Pipeline) execFilter(req *Request, filter interface{}) (res *http.Response) {
 	if _, skipTracking := filter.(*Pipeline); !skipTracking {
 		t := reflect.TypeOf(filter)
 		req.startPipelineStage(t.String())
 		defer req.finishPipelineStage()
 	}
-	return filter.FilterRequest(req)
+	if pres := protect(req, func() { res = p.filterRequest(req, filter) }); pres != nil {
+		res = pres
+	}
+	return
 }
 
-func (p *Pipeline) down(req *Request, res *http.Response) {
+func (p *Pipeline) filterRequest(req *Request, filter interface{}) *http.Response {
+	if ef, ok := filter.(ErrorFilter); ok {
+		res, err := ef.FilterRequestErr(req)
+		if err != nil {
+			return req.failed(res, err, p.ErrorRenderer)
+		}
+		return res
+	}
+	return filter.(RequestFilter).FilterRequest(req)
+}
+
+func (p *Pipeline) down(req *Request, res *http.Response) *http.Response {
 	for e := p.Downstream.Front(); e != nil; e = e.Next() {
 		if filter, ok := e.Value.(ResponseFilter); ok {
 			t := reflect.TypeOf(filter)
 			req.startPipelineStage(t.String())
-			filter.FilterResponse(req, res)
+			if pres := protect(req, func() { filter.FilterResponse(req, res) }); pres != nil {
+				if res.Body != nil {
+					res.Body.Close()
+				}
+				res = pres
+			}
 			req.finishPipelineStage()
 		} else {
 			// TODO
 			break
 		}
 	}
+	return res
 }
@@ -0,0 +1,72 @@
+package falcore
+
+import (
+	"fmt"
+	"sync"
+)
+
+// The outcome of a pipeline stage, kept in PipelineStageStat.Status.
+// falcore doesn't give the values any meaning besides setting StatusFail
+// and StatusTimeout on failures it catches itself, but they're part of
+// the request's Signature.  Filters can register their own with
+// RegisterPipelineStatus.
+type PipelineStatus byte
+
+const (
+	StatusSuccess     PipelineStatus = iota // General run successfully
+	StatusSkip                              // Skipped all or most of the work of this stage
+	StatusFail                              // General fail
+	StatusBodySkipped                       // StringBodyFilter left the request body alone
+	StatusTimeout                           // A Server read or write timeout expired during this stage
+)
+
+type pipelineStatusInfo struct {
+	name        string
+	description string
+}
+
+var pipelineStatuses = map[PipelineStatus]pipelineStatusInfo{
+	StatusSuccess:     {"success", "Run successfully"},
+	StatusSkip:        {"skip", "Skipped all or most of the work of the stage"},
+	StatusFail:        {"fail", "Failed"},
+	StatusBodySkipped: {"body-skipped", "The request body wasn't cached"},
+	StatusTimeout:     {"timeout", "A read or write timeout expired"},
+}
+var pipelineStatusMutex sync.RWMutex
+
+// Gives a custom status a name and description for the stats and Trace
+// output.  Meant to be called from a package var or init, like
+//
+//	var StatusCacheHit = falcore.RegisterPipelineStatus(20, "cache-hit", "Served from the cache")
+//
+// Registering a status twice panics.
+func RegisterPipelineStatus(status PipelineStatus, name, description string) PipelineStatus {
+	pipelineStatusMutex.Lock()
+	defer pipelineStatusMutex.Unlock()
+	if info, ok := pipelineStatuses[status]; ok {
+		panic(fmt.Sprintf("falcore: PipelineStatus %d is already registered as %q", status, info.name))
+	}
+	pipelineStatuses[status] = pipelineStatusInfo{name, description}
+	return status
+}
+
+func lookupPipelineStatus(status PipelineStatus) (pipelineStatusInfo, bool) {
+	pipelineStatusMutex.RLock()
+	defer pipelineStatusMutex.RUnlock()
+	info, ok := pipelineStatuses[status]
+	return info, ok
+}
+
+// The registered name, or the number for unregistered statuses
+func (s PipelineStatus) String() string {
+	if info, ok := lookupPipelineStatus(s); ok {
+		return info.name
+	}
+	return fmt.Sprintf("%d", byte(s))
+}
+
+// The registered description, if there is one
+func (s PipelineStatus) Description() string {
+	info, _ := lookupPipelineStatus(s)
+	return info.description
+}
@@ -0,0 +1,49 @@
+package falcore
+
+import (
+	"net/http"
+	"testing"
+)
+
+var statusCacheHit = RegisterPipelineStatus(200, "cache-hit", "Served from the cache")
+
+func TestPipelineStatusNames(t *testing.T) {
+	for status, name := range map[PipelineStatus]string{
+		StatusSuccess:  "success",
+		StatusFail:     "fail",
+		StatusTimeout:  "timeout",
+		statusCacheHit: "cache-hit",
+		201:            "201",
+	} {
+		if status.String() != name {
+			t.Errorf("Expected %v got %v", name, status)
+		}
+	}
+	if statusCacheHit.Description() != "Served from the cache" || PipelineStatus(201).Description() != "" {
+		t.Errorf("Unexpected descriptions %q %q", statusCacheHit.Description(), PipelineStatus(201).Description())
+	}
+}
+
+func TestRegisterPipelineStatusTwice(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected registering a taken status to panic")
+		}
+	}()
+	RegisterPipelineStatus(StatusSkip, "skipped", "")
+}
+
+func TestSignaturePath(t *testing.T) {
+	p := NewPipeline()
+	p.Upstream.PushBack(NewRequestFilter(func(req *Request) *http.Response {
+		req.CurrentStage.Status = statusCacheHit
+		return nil
+	}))
+	p.Upstream.PushBack(NewRequestFilter(helloFilter))
+	req := validGetRequest()
+	p.execute(req)
+	expected := "*falcore.genericRequestFilter:cache-hit *falcore.genericRequestFilter:success"
+	if path := req.SignaturePath(); path != expected {
+		t.Errorf("Expected %q got %q", expected, path)
+	}
+}
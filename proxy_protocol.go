@@ -0,0 +1,324 @@
+package falcore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Keys in Request.Context set when a connection arrived with a PROXY header
+const (
+	// The *ProxyHeader
+	ProxyHeaderContextKey = "falcore.proxy"
+	// The authority (usually the SNI host name) the client connected to, if known
+	ProxyAuthorityContextKey = "falcore.proxy.authority"
+	// The *ProxyTLS if the client connected to the proxy with TLS
+	ProxyTLSContextKey = "falcore.proxy.tls"
+)
+
+// PROXY protocol v2 TLV types
+const (
+	proxyTLVALPN      = 0x01
+	proxyTLVAuthority = 0x02
+	proxyTLVSSL       = 0x20
+	proxyTLVSSLVer    = 0x21
+	proxyTLVSSLCN     = 0x22
+	proxyTLVSSLCipher = 0x23
+	proxyTLVSSLSigAlg = 0x24
+	proxyTLVSSLKeyAlg = 0x25
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errProxyUntrusted = errors.New("PROXY header from untrusted source")
+
+// The information from a HAProxy PROXY protocol header.  See
+// http://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+type ProxyHeader struct {
+	// 1 or 2
+	Version int
+	// The client's address and the address it connected to on the proxy
+	Source      net.Addr
+	Destination net.Addr
+	// Application protocol negotiated by the proxy (v2 only)
+	ALPN string
+	// Host name the client connected to (v2 only)
+	Authority string
+	// Details of the client's TLS connection to the proxy or nil (v2 only)
+	TLS *ProxyTLS
+	// All the v2 TLVs by type
+	TLVs map[byte][]byte
+}
+
+// The PP2_TYPE_SSL TLV
+type ProxyTLS struct {
+	// PP2_CLIENT_* bit field
+	Client byte
+	// Whether the client presented a certificate that the proxy verified
+	Verified bool
+	Version  string
+	CN       string
+	Cipher   string
+	SigAlg   string
+	KeyAlg   string
+}
+
+// Wraps a listener so every accepted connection is checked for a PROXY header
+type proxyListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: c, trusted: l.trusted}, nil
+}
+
+// A connection that may start with a PROXY header.  The header is read
+// on the first call to Read, RemoteAddr or LocalAddr so that Accept
+// never blocks on a slow client.  Reading the header is subject to
+// whatever read deadline the Server has set on the connection.
+type proxyConn struct {
+	net.Conn
+	trusted []*net.IPNet
+	br      *bufio.Reader
+	once    sync.Once
+	header  *ProxyHeader
+	err     error
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.header != nil && c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.header != nil && c.header.Destination != nil {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+// The parsed header or nil if the connection didn't send one
+func (c *proxyConn) proxyHeader() *ProxyHeader {
+	c.once.Do(c.readHeader)
+	return c.header
+}
+
+// Finds the PROXY header for a connection, looking through TLS and h2c
+func connProxyHeader(c net.Conn) *ProxyHeader {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	if bc, ok := c.(*bufferedConn); ok {
+		c = bc.Conn
+	}
+	if pc, ok := c.(*proxyConn); ok {
+		return pc.proxyHeader()
+	}
+	return nil
+}
+
+// Connections from non-IP addresses, like Unix sockets, are always
+// trusted, even when no networks are.  Only local processes can connect
+// to those.
+func (c *proxyConn) isTrusted() bool {
+	addr, ok := c.Conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	for _, n := range c.trusted {
+		if n.Contains(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *proxyConn) readHeader() {
+	c.br = bufio.NewReader(c.Conn)
+	var first []byte
+	if first, c.err = c.br.Peek(1); c.err != nil {
+		return
+	}
+	switch first[0] {
+	case 'P':
+		if b, err := c.br.Peek(6); err != nil || string(b) != "PROXY " {
+			return
+		}
+		if !c.isTrusted() {
+			c.err = errProxyUntrusted
+		} else {
+			c.header, c.err = readProxyV1(c.br)
+		}
+	case '\r':
+		if b, err := c.br.Peek(len(proxyV2Signature)); err != nil || !bytes.Equal(b, proxyV2Signature) {
+			return
+		}
+		if !c.isTrusted() {
+			c.err = errProxyUntrusted
+		} else {
+			c.header, c.err = readProxyV2(c.br)
+		}
+	}
+	if c.err != nil {
+		Warn("Rejecting PROXY connection from %v: %v", c.Conn.RemoteAddr(), c.err)
+	}
+}
+
+// The longest v1 header, including the CRLF
+const proxyV1MaxLen = 107
+
+// PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n
+func readProxyV1(br *bufio.Reader) (*ProxyHeader, error) {
+	// peek rather than ReadString so a peer that never sends the newline
+	// can't make us buffer more than the longest valid header
+	var line string
+	for n := 0; line == ""; {
+		want := br.Buffered()
+		if want <= n {
+			want = n + 1
+		}
+		if want > proxyV1MaxLen {
+			want = proxyV1MaxLen
+		}
+		b, err := br.Peek(want)
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			line = string(b[:i+1])
+			br.Discard(i + 1)
+		} else if err != nil {
+			return nil, err
+		} else if len(b) >= proxyV1MaxLen {
+			return nil, errors.New("PROXY v1 header too long")
+		} else {
+			n = len(b)
+		}
+	}
+	if !strings.HasSuffix(line, "\r\n") {
+		return nil, errors.New("Bad PROXY v1 header")
+	}
+	fields := strings.Fields(line)
+	h := &ProxyHeader{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		// the proxy doesn't know, use the connection's addresses
+		return h, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("Bad PROXY v1 header %q", line)
+	}
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if srcIP == nil || dstIP == nil || err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("Bad PROXY v1 addresses %q", line)
+	}
+	h.Source = &net.TCPAddr{IP: srcIP, Port: int(srcPort)}
+	h.Destination = &net.TCPAddr{IP: dstIP, Port: int(dstPort)}
+	return h, nil
+}
+
+func readProxyV2(br *bufio.Reader) (*ProxyHeader, error) {
+	var fixed [16]byte
+	if _, err := io.ReadFull(br, fixed[:]); err != nil {
+		return nil, err
+	}
+	if fixed[12]>>4 != 2 {
+		return nil, fmt.Errorf("Bad PROXY v2 version %d", fixed[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return nil, err
+	}
+
+	h := &ProxyHeader{Version: 2}
+	command := fixed[12] & 0xF
+	if command == 0 {
+		// LOCAL: health checks from the proxy itself
+		return h, nil
+	} else if command != 1 {
+		return nil, fmt.Errorf("Bad PROXY v2 command %d", command)
+	}
+
+	var addrLen int
+	switch fixed[13] >> 4 {
+	case 0x1: // IPv4
+		addrLen = 12
+		if len(payload) >= addrLen {
+			h.Source = &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}
+			h.Destination = &net.TCPAddr{IP: net.IP(payload[4:8]), Port: int(binary.BigEndian.Uint16(payload[10:12]))}
+		}
+	case 0x2: // IPv6
+		addrLen = 36
+		if len(payload) >= addrLen {
+			h.Source = &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}
+			h.Destination = &net.TCPAddr{IP: net.IP(payload[16:32]), Port: int(binary.BigEndian.Uint16(payload[34:36]))}
+		}
+	case 0x3: // Unix
+		addrLen = 216
+	}
+	if len(payload) < addrLen {
+		return nil, errors.New("Short PROXY v2 address block")
+	}
+
+	var err error
+	if h.TLVs, err = parseProxyTLVs(payload[addrLen:]); err != nil {
+		return nil, err
+	}
+	h.ALPN = string(h.TLVs[proxyTLVALPN])
+	h.Authority = string(h.TLVs[proxyTLVAuthority])
+	if ssl, ok := h.TLVs[proxyTLVSSL]; ok && len(ssl) >= 5 {
+		h.TLS = &ProxyTLS{
+			Client:   ssl[0],
+			Verified: binary.BigEndian.Uint32(ssl[1:5]) == 0,
+		}
+		sub, err := parseProxyTLVs(ssl[5:])
+		if err != nil {
+			return nil, err
+		}
+		h.TLS.Version = string(sub[proxyTLVSSLVer])
+		h.TLS.CN = string(sub[proxyTLVSSLCN])
+		h.TLS.Cipher = string(sub[proxyTLVSSLCipher])
+		h.TLS.SigAlg = string(sub[proxyTLVSSLSigAlg])
+		h.TLS.KeyAlg = string(sub[proxyTLVSSLKeyAlg])
+	}
+	return h, nil
+}
+
+func parseProxyTLVs(b []byte) (map[byte][]byte, error) {
+	tlvs := make(map[byte][]byte)
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return nil, errors.New("Short PROXY v2 TLV")
+		}
+		l := int(binary.BigEndian.Uint16(b[1:3]))
+		if len(b) < 3+l {
+			return nil, errors.New("Short PROXY v2 TLV")
+		}
+		tlvs[b[0]] = b[3 : 3+l]
+		b = b[3+l:]
+	}
+	return tlvs, nil
+}
@@ -0,0 +1,171 @@
+package falcore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func remoteAddrFilter(req *Request) *http.Response {
+	body := req.RemoteAddr.String()
+	if authority, ok := req.Context[ProxyAuthorityContextKey]; ok {
+		body += " " + authority.(string)
+	}
+	return SimpleResponse(req.HttpRequest, 200, nil, body)
+}
+
+func newProxyTestServer(t *testing.T, trusted ...string) *Server {
+	srv := newTestServer(t, remoteAddrFilter)
+	srv.ProxyProtocol = true
+	for _, cidr := range trusted {
+		_, n, _ := net.ParseCIDR(cidr)
+		srv.ProxyProtocolTrusted = append(srv.ProxyProtocolTrusted, n)
+	}
+	startTestServer(srv)
+	return srv
+}
+
+// Builds a v2 PROXY header for a TCP4 connection with an authority TLV
+func proxyV2Header(src, dst string, srcPort, dstPort uint16, authority string) []byte {
+	var payload bytes.Buffer
+	payload.Write(net.ParseIP(src).To4())
+	payload.Write(net.ParseIP(dst).To4())
+	binary.Write(&payload, binary.BigEndian, srcPort)
+	binary.Write(&payload, binary.BigEndian, dstPort)
+	payload.WriteByte(proxyTLVAuthority)
+	binary.Write(&payload, binary.BigEndian, uint16(len(authority)))
+	payload.WriteString(authority)
+
+	var b bytes.Buffer
+	b.Write(proxyV2Signature)
+	b.WriteByte(0x21) // version 2, PROXY
+	b.WriteByte(0x11) // TCP over IPv4
+	binary.Write(&b, binary.BigEndian, uint16(payload.Len()))
+	b.Write(payload.Bytes())
+	return b.Bytes()
+}
+
+func TestProxyProtocolV1(t *testing.T) {
+	srv := newProxyTestServer(t, "127.0.0.0/8")
+	defer srv.StopAccepting()
+
+	c, br := dialTestServer(t, srv)
+	defer c.Close()
+	raw := "PROXY TCP4 1.2.3.4 5.6.7.8 1111 80\r\nGET / HTTP/1.1\r\nHost: test\r\n\r\n"
+	if _, body := roundTrip(t, c, br, raw); body != "1.2.3.4:1111" {
+		t.Errorf("Expected the proxied address: %q", body)
+	}
+	// the header only comes once per connection
+	if _, body := roundTrip(t, c, br, "GET / HTTP/1.1\r\nHost: test\r\n\r\n"); body != "1.2.3.4:1111" {
+		t.Errorf("Expected the proxied address on keep-alive: %q", body)
+	}
+}
+
+func TestProxyProtocolV2(t *testing.T) {
+	srv := newProxyTestServer(t, "127.0.0.0/8")
+	defer srv.StopAccepting()
+
+	c, br := dialTestServer(t, srv)
+	defer c.Close()
+	raw := string(proxyV2Header("10.1.2.3", "10.0.0.1", 4321, 443, "example.com")) +
+		"GET / HTTP/1.1\r\nHost: test\r\n\r\n"
+	if _, body := roundTrip(t, c, br, raw); body != "10.1.2.3:4321 example.com" {
+		t.Errorf("Expected the proxied address and authority: %q", body)
+	}
+}
+
+func TestProxyProtocolNoHeader(t *testing.T) {
+	srv := newProxyTestServer(t, "127.0.0.0/8")
+	defer srv.StopAccepting()
+
+	c, br := dialTestServer(t, srv)
+	defer c.Close()
+	if res, _ := roundTrip(t, c, br, "GET / HTTP/1.1\r\nHost: test\r\n\r\n"); res.StatusCode != 200 {
+		t.Errorf("Expected plain requests to work: %v", res.StatusCode)
+	}
+}
+
+func TestProxyProtocolUntrusted(t *testing.T) {
+	srv := newProxyTestServer(t, "10.0.0.0/8")
+	defer srv.StopAccepting()
+
+	c, br := dialTestServer(t, srv)
+	defer c.Close()
+	c.Write([]byte("PROXY TCP4 1.2.3.4 5.6.7.8 1111 80\r\nGET / HTTP/1.1\r\nHost: test\r\n\r\n"))
+	if !connClosed(c, br) {
+		t.Errorf("Expected a PROXY header from an untrusted address to be rejected")
+	}
+}
+
+func TestProxyProtocolNoneTrusted(t *testing.T) {
+	srv := newProxyTestServer(t)
+	defer srv.StopAccepting()
+
+	c, br := dialTestServer(t, srv)
+	defer c.Close()
+	c.Write([]byte("PROXY TCP4 1.2.3.4 5.6.7.8 1111 80\r\nGET / HTTP/1.1\r\nHost: test\r\n\r\n"))
+	if !connClosed(c, br) {
+		t.Errorf("Expected a PROXY header to be rejected when no sources are trusted")
+	}
+}
+
+// Unix socket peers are trusted even when no networks are
+func TestProxyProtocolUnixSocket(t *testing.T) {
+	srv := newTestServer(t, remoteAddrFilter)
+	srv.ProxyProtocol = true
+	sock := fmt.Sprintf("%v/falcore_proxy_test_%v.sock", os.TempDir(), os.Getpid())
+	defer os.Remove(sock)
+	if err := srv.Listen("unix", sock); err != nil {
+		t.Fatalf("Could not listen on unix socket: %v", err)
+	}
+	startTestServer(srv)
+	defer srv.StopAccepting()
+
+	c, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatalf("Could not connect to unix socket: %v", err)
+	}
+	defer c.Close()
+	raw := "PROXY TCP4 1.2.3.4 5.6.7.8 1111 80\r\nGET / HTTP/1.1\r\nHost: test\r\n\r\n"
+	if _, body := roundTrip(t, c, bufio.NewReader(c), raw); body != "1.2.3.4:1111" {
+		t.Errorf("Expected the proxied address: %q", body)
+	}
+}
+
+func TestProxyProtocolV1TooLong(t *testing.T) {
+	srv := newProxyTestServer(t, "127.0.0.0/8")
+	defer srv.StopAccepting()
+
+	c, br := dialTestServer(t, srv)
+	defer c.Close()
+	// never sends the newline
+	c.Write([]byte("PROXY TCP4 " + strings.Repeat("1", 200)))
+	if !connClosed(c, br) {
+		t.Errorf("Expected an overlong PROXY header to be rejected")
+	}
+}
+
+func TestReadProxyV1(t *testing.T) {
+	bad := []string{
+		"PROXY TCP4 1.2.3.4 5.6.7.8 1111\r\n",
+		"PROXY TCP4 1.2.3.4 nope 1111 80\r\n",
+		"PROXY TCP4 1.2.3.4 5.6.7.8 1111 80\n",
+		"PROXY UDP4 1.2.3.4 5.6.7.8 1111 80\r\n",
+		"PROXY TCP4 " + strings.Repeat(" ", 100) + "1.2.3.4 5.6.7.8 1111 80\r\n",
+	}
+	for _, line := range bad {
+		if _, err := readProxyV1(bufio.NewReader(bytes.NewBufferString(line))); err == nil {
+			t.Errorf("Expected an error for %q", line)
+		}
+	}
+	h, err := readProxyV1(bufio.NewReader(bytes.NewBufferString("PROXY UNKNOWN\r\n")))
+	if err != nil || h.Source != nil {
+		t.Errorf("Expected UNKNOWN to keep the connection's addresses: %v %v", h, err)
+	}
+}
@@ -0,0 +1,84 @@
+package falcore
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+// The body of a HandlerFilter response fails with this when the handler
+// panics after it started writing
+var errHandlerPanic = errors.New("handler panicked")
+
+// Runs f and turns a panic into an error response for the request.
+// Returns nil if f didn't panic.
+func protect(req *Request, f func()) (res *http.Response) {
+	defer func() {
+		if v := recover(); v != nil {
+			where := ""
+			if req.CurrentStage != nil {
+				where = req.CurrentStage.Name
+				req.CurrentStage.Err = fmt.Errorf("panic: %v", v)
+			}
+			req.logPanic(where, v)
+			res = req.panicResponse()
+		}
+	}()
+	f()
+	return nil
+}
+
+// Logs a recovered panic with the stack and counts it.  Must be called
+// from the deferred function that recovered.
+func (fReq *Request) logPanic(where string, v interface{}) {
+	Error("%s PANIC in %s: %v\n%s", fReq.ID, where, v, debug.Stack())
+	if fReq.srv != nil {
+		fReq.srv.stats.panics.Add(1)
+	}
+}
+
+// Marks the CurrentStage failed and produces the response with the
+// Server's PanicFilter or a plain 500
+func (fReq *Request) panicResponse() (res *http.Response) {
+	if fReq.CurrentStage != nil {
+		fReq.CurrentStage.Status = StatusFail
+	}
+	if fReq.srv != nil && fReq.srv.PanicFilter != nil {
+		func() {
+			defer func() {
+				if v := recover(); v != nil {
+					Error("%s PANIC in PanicFilter: %v\n%s", fReq.ID, v, debug.Stack())
+					res = nil
+				}
+			}()
+			res = fReq.srv.PanicFilter.FilterRequest(fReq)
+		}()
+	}
+	if res == nil {
+		res = SimpleResponse(fReq.HttpRequest, 500, nil, "Internal Server Error\n")
+	}
+	return
+}
+
+// Deferred by connection handlers.  Whatever was written of the response
+// can't be taken back so the connection is just closed.  Like net/http,
+// http.ErrAbortHandler aborts quietly.
+func (srv *Server) recoverConn() {
+	if v := recover(); v != nil && v != http.ErrAbortHandler {
+		Error("%s SERVER PANIC serving connection: %v\n%s", srv.serverLogPrefix(), v, debug.Stack())
+		srv.stats.panics.Add(1)
+	}
+}
+
+// Deferred by HTTP/2 streams.  The stream is reset so the client doesn't
+// take a partial response for a whole one.
+func (srv *Server) recoverStream() {
+	if v := recover(); v != nil {
+		if v != http.ErrAbortHandler {
+			Error("%s SERVER PANIC serving stream: %v\n%s", srv.serverLogPrefix(), v, debug.Stack())
+			srv.stats.panics.Add(1)
+		}
+		panic(http.ErrAbortHandler)
+	}
+}
@@ -0,0 +1,153 @@
+package falcore
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func panicFilter(req *Request) *http.Response {
+	panic("filter blew up")
+}
+
+// The status of the stage named name
+func stageStatus(req *Request, name string) (PipelineStatus, bool) {
+	for e := req.PipelineStageStats.Front(); e != nil; e = e.Next() {
+		if pss := e.Value.(*PipelineStageStat); pss.Name == name {
+			return pss.Status, true
+		}
+	}
+	return 0, false
+}
+
+func TestPipelinePanic(t *testing.T) {
+	p := NewPipeline()
+	p.Upstream.PushBack(NewRequestFilter(panicFilter))
+	p.Upstream.PushBack(NewRequestFilter(helloFilter))
+	seen := false
+	p.Downstream.PushBack(NewResponseFilter(func(req *Request, res *http.Response) {
+		seen = true
+	}))
+
+	req := validGetRequest()
+	res := p.execute(req)
+	if res.StatusCode != 500 {
+		t.Errorf("Expected 500 got %v", res.StatusCode)
+	}
+	if !seen {
+		t.Errorf("Expected the response filters to run on the error response")
+	}
+	if status, ok := stageStatus(req, "*falcore.genericRequestFilter"); !ok || status != StatusFail {
+		t.Errorf("Expected the failed stage to have the fail status, got %v %v", status, ok)
+	}
+	if req.PipelineStageStats.Len() != 2 {
+		t.Errorf("Expected the pipeline to stop at the panic: %v stages", req.PipelineStageStats.Len())
+	}
+}
+
+func TestPipelineRouterPanic(t *testing.T) {
+	p := NewPipeline()
+	p.Upstream.PushBack(NewRouter(func(req *Request) RequestFilter {
+		panic("router blew up")
+	}))
+	if res := p.execute(validGetRequest()); res.StatusCode != 500 {
+		t.Errorf("Expected 500 got %v", res.StatusCode)
+	}
+}
+
+func TestPipelineResponseFilterPanic(t *testing.T) {
+	p := NewPipeline()
+	p.Upstream.PushBack(NewRequestFilter(helloFilter))
+	p.Downstream.PushBack(NewResponseFilter(func(req *Request, res *http.Response) {
+		panic("response filter blew up")
+	}))
+	p.Downstream.PushBack(NewResponseFilter(func(req *Request, res *http.Response) {
+		res.Header.Set("X-After", "yes")
+	}))
+
+	res := p.execute(validGetRequest())
+	if res.StatusCode != 500 || res.Header.Get("X-After") != "yes" {
+		t.Errorf("Expected the 500 to replace the response got %v %v", res.StatusCode, res.Header)
+	}
+}
+
+func TestServerPanicFilter(t *testing.T) {
+	srv := newTestServer(t, func(req *Request) *http.Response {
+		if req.HttpRequest.URL.Path == "/panic" {
+			panic("filter blew up")
+		}
+		return SimpleResponse(req.HttpRequest, 200, nil, "hello")
+	})
+	srv.PanicFilter = NewRequestFilter(func(req *Request) *http.Response {
+		return SimpleResponse(req.HttpRequest, 500, nil, "sorry about "+req.CurrentStage.Name)
+	})
+	startTestServer(srv)
+	defer srv.Shutdown(time.Now().Add(time.Second))
+
+	c, br := dialTestServer(t, srv)
+	defer c.Close()
+	res, body := roundTrip(t, c, br, "GET /panic HTTP/1.1\r\nHost: test\r\n\r\n")
+	if res.StatusCode != 500 || body != "sorry about *falcore.genericRequestFilter" {
+		t.Errorf("Expected the PanicFilter response got %v %q", res.StatusCode, body)
+	}
+	// the connection and the server are still fine
+	if _, body := roundTrip(t, c, br, "GET / HTTP/1.1\r\nHost: test\r\n\r\n"); body != "hello" {
+		t.Errorf("Expected hello after the panic got %q", body)
+	}
+	if stats := srv.Stats(); stats.Panics != 1 {
+		t.Errorf("Expected a panic to be counted: %+v", stats)
+	}
+}
+
+func TestServerStreamPanic(t *testing.T) {
+	srv := newTestServer(t, func(req *Request) *http.Response {
+		return StreamResponse(req.HttpRequest, 200, nil, func(w *StreamWriter) error {
+			w.Write([]byte("partial"))
+			w.Flush()
+			panic("stream blew up")
+		})
+	})
+	startTestServer(srv)
+	defer srv.Shutdown(time.Now().Add(time.Second))
+
+	c, br := dialTestServer(t, srv)
+	defer c.Close()
+	io.WriteString(c, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("Read response failed: %v", err)
+	}
+	if _, err := ioutil.ReadAll(res.Body); err == nil {
+		t.Errorf("Expected the chunked body to be cut short")
+	}
+	if stats := waitForStats(t, srv, func(s ServerStats) bool { return s.Panics == 1 }); stats.Panics != 1 {
+		t.Errorf("Expected a panic to be counted: %+v", stats)
+	}
+}
+
+func TestHandlerFilterPanic(t *testing.T) {
+	hff := NewHandlerFilter(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("handler blew up")
+	}))
+	tmp, _ := http.NewRequest("GET", "/hello", nil)
+	req, res := TestWithRequest(tmp, hff, nil)
+	if res.StatusCode != 500 {
+		t.Errorf("Expected 500 got %v", res.StatusCode)
+	}
+	if req.CurrentStage.Status != StatusFail {
+		t.Errorf("Expected the fail status got %v", req.CurrentStage.Status)
+	}
+
+	// after the response started the body is cut short
+	hff = NewHandlerFilter(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "partial")
+		panic("handler blew up")
+	}))
+	tmp, _ = http.NewRequest("GET", "/hello", nil)
+	_, res = TestWithRequest(tmp, hff, nil)
+	if _, err := ioutil.ReadAll(res.Body); err != errHandlerPanic {
+		t.Errorf("Expected the body to fail got %v", err)
+	}
+}
@@ -2,6 +2,10 @@ package falcore
 
 import (
 	"container/list"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"fmt"
 	"hash"
 	"hash/crc32"
@@ -9,6 +13,7 @@ import (
 	"net"
 	"net/http"
 	"reflect"
+	"strings"
 	"time"
 )
 
@@ -50,6 +55,10 @@ type Request struct {
 	piplineTot         time.Duration
 	Overhead           time.Duration
 	Context            map[string]interface{}
+	srv                *Server
+	bodyLimit          *bodyLimitReader
+	bodyRejected       bool
+	expectContinue     *continueReader
 }
 
 // Used internally to create and initialize a new request.
@@ -60,7 +69,22 @@ func newRequest(request *http.Request, conn net.Conn, startTime time.Time) *Requ
 	fReq.StartTime = startTime
 	fReq.Connection = conn
 	if conn != nil {
-		fReq.RemoteAddr = conn.RemoteAddr().(*net.TCPAddr)
+		// nil for connections that aren't TCP, like Unix sockets
+		fReq.RemoteAddr, _ = conn.RemoteAddr().(*net.TCPAddr)
+		// the handshake is done by the time the request has been read
+		if tc, ok := conn.(*tls.Conn); ok && request.TLS == nil {
+			state := tc.ConnectionState()
+			request.TLS = &state
+		}
+		if h := connProxyHeader(conn); h != nil {
+			fReq.Context[ProxyHeaderContextKey] = h
+			if h.Authority != "" {
+				fReq.Context[ProxyAuthorityContextKey] = h.Authority
+			}
+			if h.TLS != nil {
+				fReq.Context[ProxyTLSContextKey] = h.TLS
+			}
+		}
 	}
 	// create a semi-unique id to track a connection in the logs
 	// ID is the least significant decimal digits of time with some randomization
@@ -74,13 +98,70 @@ func newRequest(request *http.Request, conn net.Conn, startTime time.Time) *Requ
 	// http.Server (and presumably google app engine) already handle this
 	// case.  So we don't need to do anything if we don't own the
 	// connection.
-	if conn != nil && request.Header.Get("Expect") == "100-continue" {
-		request.Body = &continueReader{req: fReq, r: request.Body}
+	if conn != nil && expectsContinue(request) {
+		fReq.expectContinue = &continueReader{req: fReq, r: request.Body}
+		request.Body = fReq.expectContinue
 	}
 
 	return fReq
 }
 
+// Closed when the request is cancelled because the client disconnected,
+// the Server's Shutdown deadline passed or WriteTimeout expired.  Long
+// running filters should give up when it's closed.  The same signal is
+// available as HttpRequest.Context().
+func (fReq *Request) Done() <-chan struct{} {
+	return fReq.HttpRequest.Context().Done()
+}
+
+// Why the request was cancelled: ErrClientDisconnected, ErrServerShutdown,
+// ErrRequestTimeout or context.Canceled.  Nil until Done is closed.
+func (fReq *Request) Err() error {
+	return context.Cause(fReq.HttpRequest.Context())
+}
+
+// The TLS handshake state or nil if the request didn't come over TLS
+func (fReq *Request) TLS() *tls.ConnectionState {
+	return fReq.HttpRequest.TLS
+}
+
+// The client's certificate chain, leaf first, if it was verified against
+// Server.TLSClientCAs.  Nil if the client sent no certificate or it wasn't
+// verified.
+func (fReq *Request) VerifiedPeerChain() []*x509.Certificate {
+	if state := fReq.TLS(); state != nil && len(state.VerifiedChains) > 0 {
+		return state.VerifiedChains[0]
+	}
+	return nil
+}
+
+// The subject of the client's verified certificate
+func (fReq *Request) PeerSubject() (subject pkix.Name, ok bool) {
+	if chain := fReq.VerifiedPeerChain(); len(chain) > 0 {
+		return chain[0].Subject, true
+	}
+	return
+}
+
+// The subject alternative names (DNS names, email addresses, IP addresses
+// and URIs) of the client's verified certificate
+func (fReq *Request) PeerSANs() []string {
+	chain := fReq.VerifiedPeerChain()
+	if len(chain) == 0 {
+		return nil
+	}
+	leaf := chain[0]
+	sans := append([]string{}, leaf.DNSNames...)
+	sans = append(sans, leaf.EmailAddresses...)
+	for _, ip := range leaf.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range leaf.URIs {
+		sans = append(sans, uri.String())
+	}
+	return sans
+}
+
 // Returns a completed falcore.Request and response after running the single filter stage
 // The PipelineStageStats is completed in the returned Request
 // The falcore.Request.Connection and falcore.Request.RemoteAddr are nil
@@ -120,7 +201,7 @@ func (fReq *Request) appendPipelineStage(pss *PipelineStageStat) {
 // Does some required bookeeping for the pipeline and the pipeline signature
 func (fReq *Request) finishCommon() {
 	fReq.pipelineHash.Write([]byte(fReq.CurrentStage.Name))
-	fReq.pipelineHash.Write([]byte{fReq.CurrentStage.Status})
+	fReq.pipelineHash.Write([]byte{byte(fReq.CurrentStage.Status)})
 	fReq.piplineTot += fReq.CurrentStage.EndTime.Sub(fReq.CurrentStage.StartTime)
 }
 
@@ -134,6 +215,19 @@ func (fReq *Request) Signature() string {
 	return fmt.Sprintf("%X", fReq.pipelineHash.Sum32())
 }
 
+// The finished stages and their statuses that make up the Signature, like
+// "server.Init:success *falcore.StringBodyFilter:skip".  Handy for finding
+// out which path a Signature stands for.
+func (fReq *Request) SignaturePath() string {
+	var path []string
+	for e := fReq.PipelineStageStats.Front(); e != nil; e = e.Next() {
+		if pss, ok := e.Value.(*PipelineStageStat); ok && !pss.EndTime.IsZero() {
+			path = append(path, pss.String())
+		}
+	}
+	return strings.Join(path, " ")
+}
+
 // Call from RequestDoneCallback.  Logs a bunch of information about the
 // request to the falcore logger. This is a pretty big hit to performance
 // so it should only be used for debugging or development.  The source is a
@@ -146,9 +240,13 @@ func (fReq *Request) Trace() {
 	for e := l.Front(); e != nil; e = e.Next() {
 		pss, _ := e.Value.(*PipelineStageStat)
 		dur := TimeDiff(pss.StartTime, pss.EndTime)
-		Trace("%s %-30s S=%d Tot=%.4f %%=%.2f", fReq.ID, pss.Name, pss.Status, dur, dur/reqTime*100.0)
+		if pss.Err != nil {
+			Trace("%s %-30s S=%v Tot=%.4f %%=%.2f Err=%v", fReq.ID, pss.Name, pss.Status, dur, dur/reqTime*100.0, pss.Err)
+		} else {
+			Trace("%s %-30s S=%v Tot=%.4f %%=%.2f", fReq.ID, pss.Name, pss.Status, dur, dur/reqTime*100.0)
+		}
 	}
-	Trace("%s %-30s S=0 Tot=%.4f %%=%.2f", fReq.ID, "Overhead", float32(fReq.Overhead)/1.0e9, float32(fReq.Overhead)/1.0e9/reqTime*100.0)
+	Trace("%s %-30s S=%v Tot=%.4f %%=%.2f", fReq.ID, "Overhead", StatusSuccess, float32(fReq.Overhead)/1.0e9, float32(fReq.Overhead)/1.0e9/reqTime*100.0)
 }
 
 func (fReq *Request) finishRequest() {
@@ -157,24 +255,23 @@ func (fReq *Request) finishRequest() {
 }
 
 // Container for keeping stats per pipeline stage
-// Name for filter stages is reflect.TypeOf(filter).String()[1:] and the Status is 0 unless
-// it is changed explicitly in the Filter or Router.
-//
-// For the Status, the falcore library will not apply any specific meaning to the status
-// codes but the following are suggested conventional usages that we have found useful
+// Name for filter stages is reflect.TypeOf(filter).String()[1:] and the Status is StatusSuccess unless
+// it is changed explicitly in the Filter or Router.  See PipelineStatus for
+// the conventional values.
 //
-//   type PipelineStatus byte
-//   const (
-// 	    Success PipelineStatus = iota	// General Run successfully
-//	    Skip								// Skipped (all or most of the work of this stage)
-//	    Fail								// General Fail
-//	    // All others may be used as custom status codes
-//   )
+// Err is the error an ErrorFilter failed with, or whatever was passed to
+// Request.Fail.
 type PipelineStageStat struct {
 	Name      string
-	Status    byte
+	Status    PipelineStatus
 	StartTime time.Time
 	EndTime   time.Time
+	Err       error
+}
+
+// "Name:status"
+func (pss *PipelineStageStat) String() string {
+	return pss.Name + ":" + pss.Status.String()
 }
 
 func NewPiplineStage(name string) *PipelineStageStat {
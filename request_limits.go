@@ -0,0 +1,239 @@
+package falcore
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// How long a rejected connection is drained before it's closed
+const rejectDrainTimeout = 500 * time.Millisecond
+
+// A request turned away before it reaches the Pipeline
+type limitError struct {
+	status int
+	reason string
+	count  *atomic.Uint64
+}
+
+func (e *limitError) Error() string {
+	return e.reason
+}
+
+func (srv *Server) maxHeaderBytes() int {
+	if srv.MaxHeaderBytes > 0 {
+		return srv.MaxHeaderBytes
+	}
+	return http.DefaultMaxHeaderBytes
+}
+
+// Reads the next request, enforcing MaxHeaderBytes, MaxHeaderCount and
+// MaxURILength.  A request over the limits gets a *limitError.
+func (srv *Server) readRequest(bpe *bufferPoolEntry) (*http.Request, error) {
+	max := srv.maxHeaderBytes()
+	// whatever is already buffered doesn't count so this is a little
+	// generous.  headerBytes makes up for it once the request is parsed.
+	bpe.setReadLimit(int64(max))
+	req, err := http.ReadRequest(bpe.br)
+	limited := bpe.limitReached()
+	bpe.setReadLimit(noReadLimit)
+	if err != nil {
+		if limited {
+			return nil, srv.headerTooLarge()
+		}
+		return nil, err
+	}
+	if lerr := srv.checkHeaderLimits(req); lerr != nil {
+		return nil, lerr
+	}
+	if headerBytes(req) > max {
+		return nil, srv.headerTooLarge()
+	}
+	return req, nil
+}
+
+func (srv *Server) headerTooLarge() *limitError {
+	return &limitError{431, "header too large", &srv.stats.headerTooLarge}
+}
+
+// The limits that apply to HTTP/2 as well.  net/http enforces
+// MaxHeaderBytes there.
+func (srv *Server) checkHeaderLimits(req *http.Request) *limitError {
+	if srv.MaxURILength > 0 && len(req.RequestURI) > srv.MaxURILength {
+		return &limitError{414, "URI too long", &srv.stats.uriTooLong}
+	}
+	if srv.MaxHeaderCount > 0 && headerCount(req) > srv.MaxHeaderCount {
+		return &limitError{431, "too many headers", &srv.stats.tooManyHeaders}
+	}
+	return nil
+}
+
+// The size of the request line and headers as they were sent, give or
+// take some whitespace
+func headerBytes(req *http.Request) int {
+	n := len(req.Method) + len(req.RequestURI) + len(req.Proto) + len(" \r\n ")
+	if req.Host != "" {
+		n += len("Host: \r\n") + len(req.Host)
+	}
+	for k, vs := range req.Header {
+		for _, v := range vs {
+			n += len(k) + len(": \r\n") + len(v)
+		}
+	}
+	return n
+}
+
+// ReadRequest moves the Host header out of Header
+func headerCount(req *http.Request) int {
+	n := 0
+	if req.Host != "" {
+		n++
+	}
+	for _, vs := range req.Header {
+		n += len(vs)
+	}
+	return n
+}
+
+// Answers a request that was over the limits.  The connection is closed
+// afterwards since the rest of the request can't be trusted.
+func (srv *Server) rejectRequest(c net.Conn, lerr *limitError) {
+	lerr.count.Add(1)
+	Warn("%s %v Rejected request: %v", srv.serverLogPrefix(), c.RemoteAddr(), lerr.reason)
+	if srv.WriteTimeout > 0 {
+		c.SetWriteDeadline(time.Now().Add(srv.WriteTimeout))
+	}
+	res := SimpleResponse(nil, lerr.status, nil, http.StatusText(lerr.status)+"\n")
+	res.Close = true
+	wbuf := bufio.NewWriter(c)
+	if res.Write(wbuf) != nil || wbuf.Flush() != nil {
+		return
+	}
+	// closing with the rest of the request unread resets the connection
+	// and the client can lose the response
+	if tc := tcpConn(c); tc != nil {
+		tc.CloseWrite()
+	}
+	c.SetReadDeadline(time.Now().Add(rejectDrainTimeout))
+	io.CopyN(ioutil.Discard, c, 256<<10)
+}
+
+// Limits request bodies for the rest of the pipeline it's in, usually
+// one route's.  It can only lower the Server's MaxBodyBytes.  See
+// Server.MaxBodyBytes for how the limit is enforced.
+type BodyLimitFilter struct {
+	MaxBodyBytes int64
+}
+
+func NewBodyLimitFilter(maxBodyBytes int64) *BodyLimitFilter {
+	return &BodyLimitFilter{MaxBodyBytes: maxBodyBytes}
+}
+
+func (f *BodyLimitFilter) FilterRequest(req *Request) *http.Response {
+	if !req.limitBody(f.MaxBodyBytes) {
+		req.CurrentStage.Status = StatusFail
+		return bodyTooLargeResponse(req.HttpRequest)
+	}
+	return nil
+}
+
+// The connection is closed afterwards because the body is left unread
+func bodyTooLargeResponse(req *http.Request) *http.Response {
+	res := SimpleResponse(req, 413, nil, "Request Entity Too Large\n")
+	res.Close = true
+	return res
+}
+
+// Caps the request body at max bytes unless it's already capped lower.
+// Returns false if Content-Length is over the limit.
+func (fReq *Request) limitBody(max int64) bool {
+	req := fReq.HttpRequest
+	var count *atomic.Uint64
+	if fReq.srv != nil {
+		count = &fReq.srv.stats.bodyTooLarge
+	}
+	if req.ContentLength > max {
+		if count != nil {
+			count.Add(1)
+		}
+		fReq.bodyRejected = true
+		return false
+	}
+	if req.Body == nil || req.Body == http.NoBody {
+		return true
+	}
+	if bl := fReq.bodyLimit; bl == nil {
+		fReq.bodyLimit = &bodyLimitReader{ReadCloser: req.Body, limit: max, n: max, count: count}
+		req.Body = fReq.bodyLimit
+	} else if max < bl.limit {
+		bl.n -= bl.limit - max
+		bl.limit = max
+	}
+	return true
+}
+
+// Whether the rest of the body should be left unread and the connection
+// closed, either because it's over the limit or because the client is
+// still waiting for 100 Continue
+func (fReq *Request) abandonBody() bool {
+	if fReq.bodyRejected || (fReq.bodyLimit != nil && fReq.bodyLimit.exceeded) {
+		return true
+	}
+	return fReq.expectContinue != nil && !fReq.expectContinue.opened
+}
+
+// Reads fail with *http.MaxBytesError once the body goes over the limit.
+// Meant for chunked bodies, since the Content-Length is checked up front.
+type bodyLimitReader struct {
+	io.ReadCloser
+	limit    int64
+	n        int64 // bytes left
+	exceeded bool
+	count    *atomic.Uint64
+}
+
+func (r *bodyLimitReader) Read(p []byte) (int, error) {
+	if r.exceeded || r.n < 0 {
+		return 0, r.exceed()
+	}
+	// one more than allowed to tell a body that's exactly the limit
+	// from one that's over it
+	if int64(len(p)) > r.n+1 {
+		p = p[:r.n+1]
+	}
+	n, err := r.ReadCloser.Read(p)
+	if int64(n) <= r.n {
+		r.n -= int64(n)
+		return n, err
+	}
+	n = int(r.n)
+	r.n = 0
+	return n, r.exceed()
+}
+
+// net/http reads the rest of the body on Close.  This stops at the limit
+// and leaves the body to be abandoned instead.
+func (r *bodyLimitReader) Close() error {
+	if r.exceeded {
+		return nil
+	}
+	if n, _ := io.CopyN(ioutil.Discard, r.ReadCloser, r.n+1); n > r.n {
+		r.exceeded = true
+		return nil
+	}
+	return r.ReadCloser.Close()
+}
+
+func (r *bodyLimitReader) exceed() error {
+	if !r.exceeded {
+		r.exceeded = true
+		if r.count != nil {
+			r.count.Add(1)
+		}
+	}
+	return &http.MaxBytesError{Limit: r.limit}
+}
@@ -0,0 +1,255 @@
+package falcore
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+var requestLimitTests = []struct {
+	name    string
+	request string
+	status  int
+	stat    func(ServerStats) uint64
+}{
+	{
+		"header too large",
+		"GET / HTTP/1.1\r\nHost: test\r\nX-Big: " + strings.Repeat("a", 2048) + "\r\n\r\n",
+		431,
+		func(s ServerStats) uint64 { return s.HeaderTooLarge },
+	},
+	{
+		"header too large over several lines",
+		"GET / HTTP/1.1\r\nHost: test\r\nX-Big: " + strings.Repeat("a", 900) + "\r\nX-Big: " + strings.Repeat("a", 900) + "\r\n\r\n",
+		431,
+		func(s ServerStats) uint64 { return s.HeaderTooLarge },
+	},
+	{
+		"too many headers",
+		"GET / HTTP/1.1\r\nHost: test\r\nA: 1\r\nB: 2\r\nC: 3\r\nD: 4\r\n\r\n",
+		431,
+		func(s ServerStats) uint64 { return s.TooManyHeaders },
+	},
+	{
+		"URI too long",
+		"GET /" + strings.Repeat("a", 100) + " HTTP/1.1\r\nHost: test\r\n\r\n",
+		414,
+		func(s ServerStats) uint64 { return s.URITooLong },
+	},
+}
+
+func TestRequestLimits(t *testing.T) {
+	for _, test := range requestLimitTests {
+		srv := newTestServer(t, helloFilter)
+		srv.MaxHeaderBytes = 1024
+		srv.MaxHeaderCount = 4
+		srv.MaxURILength = 64
+		startTestServer(srv)
+
+		c, br := dialTestServer(t, srv)
+		res, _ := roundTrip(t, c, br, test.request)
+		if res.StatusCode != test.status {
+			t.Errorf("%v: Expected %v got %v", test.name, test.status, res.StatusCode)
+		}
+		if !res.Close || !connClosed(c, br) {
+			t.Errorf("%v: Expected the connection to be closed", test.name)
+		}
+		if n := test.stat(srv.Stats()); n != 1 {
+			t.Errorf("%v: Expected the rejection to be counted, got %v", test.name, n)
+		}
+		c.Close()
+		srv.Shutdown(time.Now().Add(time.Second))
+	}
+}
+
+func TestRequestLimitsAllowed(t *testing.T) {
+	srv := newTestServer(t, helloFilter)
+	srv.MaxHeaderBytes = 1024
+	srv.MaxHeaderCount = 4
+	srv.MaxURILength = 64
+	startTestServer(srv)
+	defer srv.Shutdown(time.Now().Add(time.Second))
+
+	// right up to the limits, pipelined so they're buffered together
+	req := "GET /" + strings.Repeat("a", 63) + " HTTP/1.1\r\nHost: test\r\nA: 1\r\nB: 2\r\nC: " + strings.Repeat("c", 700) + "\r\n\r\n"
+	c, br := dialTestServer(t, srv)
+	defer c.Close()
+	for i := 0; i < 3; i++ {
+		raw := ""
+		if i == 0 {
+			raw = req + req + req
+		}
+		if res, body := roundTrip(t, c, br, raw); res.StatusCode != 200 || body != "hello" {
+			t.Errorf("Expected request %v to be allowed got %v", i, res.StatusCode)
+		}
+	}
+}
+
+// Reads the whole body and reports how it went
+func bodyLimitFilter(req *Request) *http.Response {
+	b, err := ioutil.ReadAll(req.HttpRequest.Body)
+	if _, ok := err.(*http.MaxBytesError); ok {
+		return bodyTooLargeResponse(req.HttpRequest)
+	}
+	return SimpleResponse(req.HttpRequest, 200, nil, fmt.Sprintf("read %v", len(b)))
+}
+
+func TestMaxBodyBytesContentLength(t *testing.T) {
+	srv := newTestServer(t, bodyLimitFilter)
+	srv.MaxBodyBytes = 10
+	startTestServer(srv)
+	defer srv.Shutdown(time.Now().Add(time.Second))
+
+	// rejected without asking for the body
+	c, br := dialTestServer(t, srv)
+	defer c.Close()
+	res, _ := roundTrip(t, c, br, "POST / HTTP/1.1\r\nHost: test\r\nContent-Length: 11\r\nExpect: 100-continue\r\n\r\n")
+	if res.StatusCode != 413 {
+		t.Errorf("Expected 413 got %v", res.StatusCode)
+	}
+	if !res.Close || !connClosed(c, br) {
+		t.Errorf("Expected the connection to be closed")
+	}
+	if stats := srv.Stats(); stats.BodyTooLarge != 1 {
+		t.Errorf("Expected the rejection to be counted: %+v", stats)
+	}
+
+	c, br = dialTestServer(t, srv)
+	defer c.Close()
+	if _, body := roundTrip(t, c, br, "POST / HTTP/1.1\r\nHost: test\r\nContent-Length: 10\r\n\r\n0123456789"); body != "read 10" {
+		t.Errorf("Expected a body at the limit to be read got %q", body)
+	}
+}
+
+func TestMaxBodyBytesChunked(t *testing.T) {
+	srv := newTestServer(t, bodyLimitFilter)
+	srv.MaxBodyBytes = 10
+	startTestServer(srv)
+	defer srv.Shutdown(time.Now().Add(time.Second))
+
+	c, br := dialTestServer(t, srv)
+	defer c.Close()
+	req := "POST / HTTP/1.1\r\nHost: test\r\nTransfer-Encoding: chunked\r\n\r\n"
+	if _, body := roundTrip(t, c, br, req+"5\r\n01234\r\n5\r\n56789\r\n0\r\n\r\n"); body != "read 10" {
+		t.Errorf("Expected a body at the limit to be read got %q", body)
+	}
+	// the same connection, now over the limit
+	res, _ := roundTrip(t, c, br, req+"5\r\n01234\r\n5\r\n56789\r\n1\r\nX\r\n0\r\n\r\n")
+	if res.StatusCode != 413 {
+		t.Errorf("Expected 413 got %v", res.StatusCode)
+	}
+	if !res.Close || !connClosed(c, br) {
+		t.Errorf("Expected the connection to be closed")
+	}
+	if stats := srv.Stats(); stats.BodyTooLarge != 1 {
+		t.Errorf("Expected the rejection to be counted: %+v", stats)
+	}
+}
+
+func TestBodyLimitFilter(t *testing.T) {
+	small := NewPipeline()
+	small.Upstream.PushBack(NewBodyLimitFilter(5))
+	small.Upstream.PushBack(NewRequestFilter(bodyLimitFilter))
+	router := NewPathRouter()
+	router.AddMatch("^/small", small)
+	router.AddMatch("", NewRequestFilter(bodyLimitFilter))
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(router)
+	srv := NewServer(0, pipeline)
+	if err := srv.socketListen(); err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	srv.MaxBodyBytes = 10
+	startTestServer(srv)
+	defer srv.Shutdown(time.Now().Add(time.Second))
+
+	for _, test := range []struct {
+		path   string
+		body   string
+		status int
+	}{
+		{"/small", "01234", 200},
+		{"/small", "012345", 413},
+		{"/other", "012345", 200},
+		{"/other", "0123456789X", 413},
+	} {
+		c, br := dialTestServer(t, srv)
+		raw := fmt.Sprintf("POST %v HTTP/1.1\r\nHost: test\r\nContent-Length: %v\r\n\r\n%v", test.path, len(test.body), test.body)
+		if res, _ := roundTrip(t, c, br, raw); res.StatusCode != test.status {
+			t.Errorf("%v %q: Expected %v got %v", test.path, test.body, test.status, res.StatusCode)
+		}
+		c.Close()
+	}
+}
+
+func TestExpectContinueUnread(t *testing.T) {
+	srv := newTestServer(t, helloFilter)
+	srv.ReadTimeout = 5 * time.Second
+	startTestServer(srv)
+	defer srv.Shutdown(time.Now().Add(time.Second))
+
+	// the pipeline never reads the body so the client is never told to
+	// send it.  the server mustn't wait for it.
+	c, br := dialTestServer(t, srv)
+	defer c.Close()
+	start := time.Now()
+	res, body := roundTrip(t, c, br, "POST / HTTP/1.1\r\nHost: test\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n")
+	if res.StatusCode != 200 || body != "hello" {
+		t.Errorf("Expected the response without a 100 Continue got %v %q", res.StatusCode, body)
+	}
+	if !connClosed(c, br) || time.Since(start) > time.Second {
+		t.Errorf("Expected the connection to be closed right away")
+	}
+}
+
+func TestStringBodyTooLarge(t *testing.T) {
+	tmp, _ := http.NewRequest("POST", "/hello", strings.NewReader(""))
+	tmp.ContentLength = 11 << 20
+	req, res := TestWithRequest(tmp, NewStringBodyFilter(), nil)
+	if res == nil || res.StatusCode != 413 || req.CurrentStage.Status != 2 {
+		t.Errorf("Expected 413 for a body over 10 MB got %v", res)
+	}
+}
+
+func TestMaxBodyBytesNoExpect(t *testing.T) {
+	srv := newTestServer(t, helloFilter)
+	srv.MaxBodyBytes = 10
+	startTestServer(srv)
+	defer srv.Shutdown(time.Now().Add(time.Second))
+
+	// the 413 doesn't wait for a body that's never going to be read
+	c, br := dialTestServer(t, srv)
+	defer c.Close()
+	start := time.Now()
+	res, _ := roundTrip(t, c, br, "POST / HTTP/1.1\r\nHost: test\r\nContent-Length: 100000000\r\n\r\n0123456789")
+	if res.StatusCode != 413 || time.Since(start) > time.Second {
+		t.Errorf("Expected an early 413 got %v after %v", res.StatusCode, time.Since(start))
+	}
+	if !res.Close || !connClosed(c, br) {
+		t.Errorf("Expected the connection to be closed")
+	}
+}
+
+func TestBodyLimitReaderClose(t *testing.T) {
+	body := &countingReader{r: strings.NewReader(strings.Repeat("x", 1000))}
+	bl := &bodyLimitReader{ReadCloser: ioutil.NopCloser(body), limit: 10, n: 10}
+	bl.Close()
+	if !bl.exceeded || body.n > 11 {
+		t.Errorf("Expected Close to stop at the limit: read %v", body.n)
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += n
+	return n, err
+}
@@ -2,8 +2,10 @@ package falcore
 
 import (
 	"bufio"
+	"context"
 	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
@@ -20,15 +22,145 @@ import (
 type Server struct {
 	Addr             string
 	Pipeline         *Pipeline
-	listener         net.Listener
-	listenerFile     *os.File
+	listeners        []net.Listener
+	listenerFiles    []*os.File
+	listenerFds      []int
 	stopAccepting    chan int
+	stopOnce         sync.Once
+	served           chan int
 	handlerWaitGroup *sync.WaitGroup
+	conns            map[net.Conn]*connInfo
+	connMutex        sync.Mutex
+	shutdownStatus   ShutdownStatus
 	logPrefix        string
 	AcceptReady      chan int
+	accepting        chan int
 	sendfile         bool
 	sockOpt          int
 	bufferPool       *bufferPool
+
+	// Maximum number of requests served on a single connection before
+	// it is closed.  Zero means no limit.
+	MaxRequestsPerConn int
+	// Maximum number of pipelined requests from one connection run
+	// through the Pipeline at once.  Requests a client has already sent
+	// are read ahead and run concurrently while the responses are still
+	// written in order.  Only GET, HEAD, OPTIONS and TRACE requests
+	// without a body are run ahead.
+	// Zero or one serves one request at a time.
+	MaxPipelinedRequests int
+	// How long a keep-alive connection may sit idle waiting for its
+	// next request before it is closed.  Zero means no timeout.
+	IdleTimeout time.Duration
+	// Maximum time allowed to read the request line and headers, starting
+	// when the first byte of the request arrives.  Zero means ReadTimeout
+	// is used instead.
+	ReadHeaderTimeout time.Duration
+	// Maximum time allowed to read an entire request, including the body.
+	// A stage reading the body when this expires gets the timeout status.
+	// Zero means no timeout.
+	ReadTimeout time.Duration
+	// Maximum time from the end of reading the request headers to the end
+	// of writing the response.  This includes time spent in the pipeline.
+	// Zero means no timeout.
+	WriteTimeout time.Duration
+	// Accept HAProxy PROXY protocol (v1 or v2) headers at the start of
+	// connections so that Request.RemoteAddr is the real client address
+	// instead of the load balancer's.  Connections without a header are
+	// served as usual.  Only Unix socket peers and sources in
+	// ProxyProtocolTrusted may send one.
+	ProxyProtocol bool
+	// Networks allowed to send a PROXY header.  Connections from anywhere
+	// else that send one are rejected.  Empty rejects every PROXY header
+	// over TCP so the load balancers have to be listed for ProxyProtocol to
+	// be useful.  Unix socket connections are always trusted.
+	ProxyProtocolTrusted []*net.IPNet
+	// Certificates chosen by SNI for ListenAndServeTLS.  Used when the
+	// cert and key files passed to ListenAndServeTLS are empty.
+	TLSCertificates *CertificateStore
+	// Picks the certificate for each TLS handshake.  Takes precedence over
+	// TLSCertificates.
+	TLSGetCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	// Oldest TLS version accepted, e.g. tls.VersionTLS12.  Zero uses the
+	// crypto/tls default.
+	TLSMinVersion uint16
+	// Cipher suites allowed for TLS 1.2 and older.  Empty uses the
+	// crypto/tls default.
+	TLSCipherSuites []uint16
+	// Whether TLS clients must present a certificate and whether it is
+	// verified, e.g. tls.RequireAndVerifyClientCert.  See
+	// Request.VerifiedPeerChain.
+	TLSClientAuth tls.ClientAuthType
+	// CAs client certificates are verified against.  Nil uses the system
+	// roots.
+	TLSClientCAs *x509.CertPool
+	// Negotiate HTTP/2 with ALPN on TLS listeners.  Each stream is run
+	// through the Pipeline like an HTTP/1 request.
+	HTTP2 bool
+	// Accept cleartext HTTP/2 (h2c) from clients that start with the
+	// HTTP/2 preface (prior knowledge) or ask for it with "Upgrade: h2c".
+	// Upgrade requests with a body are answered over HTTP/1.1 instead.
+	H2C bool
+	// Maximum number of open connections.  Zero means no limit.
+	MaxConnections int
+	// Maximum number of requests running through the Pipeline at once.
+	// Zero means no limit.
+	MaxConcurrentRequests int
+	// What happens to connections and requests over the limits
+	OverloadPolicy OverloadPolicy
+	// How long OverloadQueue waits for a slot.  Zero waits until one
+	// frees up or the request is cancelled.
+	OverloadQueueTimeout time.Duration
+	// Sent as Retry-After on 503s for shed connections and requests.
+	// Rounded up to whole seconds.  Zero means one second.
+	OverloadRetryAfter time.Duration
+	// Maximum size of the request line and headers.  Bigger requests get
+	// 431 Request Header Fields Too Large.  Zero means
+	// http.DefaultMaxHeaderBytes.
+	MaxHeaderBytes int
+	// Maximum number of request headers.  More get 431 Request Header
+	// Fields Too Large.  Zero means no limit.
+	MaxHeaderCount int
+	// Maximum length of the request URI.  Longer ones get 414 URI Too
+	// Long.  Zero means no limit besides MaxHeaderBytes.
+	MaxURILength int
+	// Maximum size of request bodies.  A bigger Content-Length gets 413
+	// Request Entity Too Large before the pipeline runs, without sending
+	// 100 Continue.  Reading a chunked body fails with *http.MaxBytesError
+	// once it goes over and the connection is closed after the response.
+	// See BodyLimitFilter for lower limits on some routes.  Zero means no
+	// limit.
+	MaxBodyBytes int64
+	// Runs before the pipeline for requests that send Expect:
+	// 100-continue.  It can look at the headers and return a response,
+	// like 417, 401 or 413, to turn the request away before the client
+	// sends the body.  The connection is closed afterwards.  Returning nil
+	// leaves 100 Continue to be sent when the pipeline first reads the
+	// body, or right away if the filter calls Request.Continue.
+	ExpectContinue RequestFilter
+	// Answers "OPTIONS *" requests, which are about the server as a whole
+	// so they skip the Pipeline.  Nil answers 200 with no body.
+	GlobalOptions RequestFilter
+	// Produces the response for a request whose filter panicked.  The
+	// failed stage is the request's CurrentStage.  Nil sends a plain 500.
+	PanicFilter RequestFilter
+	// Called with every error from a listener's Accept, besides the
+	// listener being closed by StopAccepting.  The accept loop backs off
+	// before trying again.  Must not block.
+	AcceptErrorCallback func(l net.Listener, err error)
+	// Called when a connection changes state, with the number of requests
+	// read from it so far.  Runs on the connection's goroutine so it
+	// should be quick.
+	ConnState func(c net.Conn, state ConnState, requests int)
+
+	http2        *http2Server
+	connSlots    chan int
+	requestSlots chan int
+	stats        serverStats
+	// parent of every request's context.  cancelled when Shutdown kills
+	// connections.
+	ctx       context.Context
+	cancelCtx context.CancelFunc
 }
 
 func NewServer(port int, pipeline *Pipeline) *Server {
@@ -36,8 +168,12 @@ func NewServer(port int, pipeline *Pipeline) *Server {
 	s.Addr = fmt.Sprintf(":%v", port)
 	s.Pipeline = pipeline
 	s.stopAccepting = make(chan int)
+	s.served = make(chan int)
+	s.conns = make(map[net.Conn]*connInfo)
 	s.AcceptReady = make(chan int, 1)
+	s.accepting = make(chan int)
 	s.handlerWaitGroup = new(sync.WaitGroup)
+	s.ctx, s.cancelCtx = context.WithCancel(context.Background())
 	s.logPrefix = fmt.Sprintf("%d", syscall.Getpid())
 
 	// openbsd/netbsd don't have TCP_NOPUSH so it's likely sendfile will be slower
@@ -60,85 +196,210 @@ func NewServer(port int, pipeline *Pipeline) *Server {
 	return s
 }
 
+// Adds a listener from an already open socket fd.  This is how a hot
+// restarted child picks up its parent's sockets.  The socket may be
+// TCP or a Unix domain socket.  May be called more than once.
 func (srv *Server) FdListen(fd int) error {
-	var err error
-	srv.listenerFile = os.NewFile(uintptr(fd), "")
-	if srv.listener, err = net.FileListener(srv.listenerFile); err != nil {
+	f := os.NewFile(uintptr(fd), "")
+	l, err := net.FileListener(f)
+	if err != nil {
 		return err
 	}
-	if _, ok := srv.listener.(*net.TCPListener); !ok {
-		return errors.New("Broken listener isn't TCP")
+	switch l.(type) {
+	case *net.TCPListener, *net.UnixListener:
+	default:
+		l.Close()
+		return errors.New("Broken listener isn't TCP or Unix")
 	}
+	_, isTCP := l.(*net.TCPListener)
+	if err = srv.setupNonBlockingFd(fd, isTCP); err != nil {
+		l.Close()
+		return err
+	}
+	srv.listeners = append(srv.listeners, l)
+	srv.listenerFiles = append(srv.listenerFiles, f)
+	srv.listenerFds = append(srv.listenerFds, fd)
 	return nil
 }
 
-func (srv *Server) socketListen() error {
-	var la *net.TCPAddr
+// Adds a listener on the network address.  Network may be one of "tcp",
+// "tcp4", "tcp6" or "unix".  May be called more than once to accept on
+// several addresses with the same pipeline.
+//
+// A stale Unix socket file left behind by a previous process is removed.
+// The socket file isn't removed when the server stops so that it
+// survives a hot restart.
+func (srv *Server) Listen(network, addr string) error {
+	var l net.Listener
 	var err error
-	if la, err = net.ResolveTCPAddr("tcp", srv.Addr); err != nil {
-		return err
-	}
-
-	var l *net.TCPListener
-	if l, err = net.ListenTCP("tcp", la); err != nil {
-		return err
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		var la *net.TCPAddr
+		if la, err = net.ResolveTCPAddr(network, addr); err != nil {
+			return err
+		}
+		if l, err = net.ListenTCP(network, la); err != nil {
+			return err
+		}
+	case "unix":
+		if c, err := net.Dial("unix", addr); err == nil {
+			c.Close()
+			return fmt.Errorf("Unix socket %v is in use", addr)
+		} else if fi, err := os.Stat(addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(addr)
+		}
+		var ul *net.UnixListener
+		if ul, err = net.ListenUnix(network, &net.UnixAddr{Name: addr, Net: network}); err != nil {
+			return err
+		}
+		ul.SetUnlinkOnClose(false)
+		l = ul
+	default:
+		return fmt.Errorf("Unsupported network %v", network)
 	}
-	srv.listener = l
 	// setup listener to be non-blocking if we're not on windows.
 	// this is required for hot restart to work.
-	return srv.setupNonBlockingListener(err, l)
+	var f *os.File
+	var fd int
+	if f, fd, err = srv.setupNonBlockingListener(l); err != nil {
+		l.Close()
+		return err
+	}
+	srv.listeners = append(srv.listeners, l)
+	if f != nil {
+		srv.listenerFiles = append(srv.listenerFiles, f)
+		srv.listenerFds = append(srv.listenerFds, fd)
+	}
+	return nil
+}
+
+func (srv *Server) socketListen() error {
+	return srv.Listen("tcp", srv.Addr)
 }
 
 func (srv *Server) ListenAndServe() error {
 	if srv.Addr == "" {
 		srv.Addr = ":http"
 	}
-	if srv.listener == nil {
+	if len(srv.listeners) == 0 {
 		if err := srv.socketListen(); err != nil {
 			return err
 		}
 	}
+	srv.prepareListeners(nil)
 	return srv.serve()
 }
 
+// The fd of the first listener
 func (srv *Server) SocketFd() int {
-	return int(srv.listenerFile.Fd())
+	if len(srv.listenerFds) == 0 {
+		return -1
+	}
+	return srv.listenerFds[0]
+}
+
+// The fds of all the listeners in the order they were added
+func (srv *Server) SocketFds() []int {
+	return srv.listenerFds
 }
 
+// The addresses of all the listeners
+func (srv *Server) Addrs() []net.Addr {
+	addrs := make([]net.Addr, len(srv.listeners))
+	for i, l := range srv.listeners {
+		addrs[i] = l.Addr()
+	}
+	return addrs
+}
+
+// Serves TLS on the listeners.  With certFile and keyFile empty the
+// certificates come from TLSGetCertificate or TLSCertificates so they can
+// be chosen by SNI and reloaded while running.
 func (srv *Server) ListenAndServeTLS(certFile, keyFile string) error {
 	if srv.Addr == "" {
 		srv.Addr = ":https"
 	}
-	config := &tls.Config{
-		Rand:       rand.Reader,
-		Time:       time.Now,
-		NextProtos: []string{"http/1.1"},
-	}
-
-	var err error
-	config.Certificates = make([]tls.Certificate, 1)
-	config.Certificates[0], err = tls.LoadX509KeyPair(certFile, keyFile)
+	config, err := srv.tlsConfig(certFile, keyFile)
 	if err != nil {
 		return err
 	}
 
-	if srv.listener == nil {
+	if len(srv.listeners) == 0 {
 		if err := srv.socketListen(); err != nil {
 			return err
 		}
 	}
 
-	srv.listener = tls.NewListener(srv.listener, config)
+	srv.prepareListeners(config)
 
 	return srv.serve()
 }
 
+func (srv *Server) tlsConfig(certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{
+		Rand:         rand.Reader,
+		Time:         time.Now,
+		NextProtos:   []string{"http/1.1"},
+		MinVersion:   srv.TLSMinVersion,
+		CipherSuites: srv.TLSCipherSuites,
+		ClientAuth:   srv.TLSClientAuth,
+		ClientCAs:    srv.TLSClientCAs,
+	}
+	if srv.HTTP2 {
+		config.NextProtos = []string{"h2", "http/1.1"}
+	}
+
+	switch {
+	case certFile != "" || keyFile != "":
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	case srv.TLSGetCertificate != nil:
+		config.GetCertificate = srv.TLSGetCertificate
+	case srv.TLSCertificates != nil:
+		config.GetCertificate = srv.TLSCertificates.GetCertificate
+	default:
+		return nil, errors.New("No TLS certificates configured")
+	}
+	return config, nil
+}
+
+// Wraps the listeners for the PROXY protocol and TLS if they're enabled
+func (srv *Server) prepareListeners(config *tls.Config) {
+	if srv.HTTP2 || srv.H2C {
+		srv.http2 = newHTTP2Server(srv)
+	}
+	for i, l := range srv.listeners {
+		if srv.ProxyProtocol {
+			l = &proxyListener{Listener: l, trusted: srv.ProxyProtocolTrusted}
+		}
+		if config != nil {
+			l = tls.NewListener(l, config)
+		}
+		srv.listeners[i] = l
+	}
+}
+
+// Stops accepting new connections.  ListenAndServe will return once the
+// open connections have finished.  See Shutdown for a version with a deadline.
 func (srv *Server) StopAccepting() {
-	close(srv.stopAccepting)
+	srv.stopOnce.Do(func() {
+		close(srv.stopAccepting)
+		if srv.http2 != nil {
+			srv.http2.shutdown()
+		}
+		// unblocks Accept
+		for _, l := range srv.listeners {
+			l.Close()
+		}
+	})
 }
 
+// The port of the first TCP listener
 func (srv *Server) Port() int {
-	if l := srv.listener; l != nil {
+	for _, l := range srv.listeners {
 		a := l.Addr()
 		if _, p, e := net.SplitHostPort(a.String()); e == nil && p != "" {
 			server_port, _ := strconv.Atoi(p)
@@ -149,26 +410,52 @@ func (srv *Server) Port() int {
 }
 
 func (srv *Server) serve() (e error) {
-	var accept = true
+	srv.prepareLimits()
 	srv.AcceptReady <- 1
+	close(srv.accepting)
+	acceptWaitGroup := new(sync.WaitGroup)
+	for _, l := range srv.listeners {
+		acceptWaitGroup.Add(1)
+		go func(l net.Listener) {
+			srv.acceptLoop(l)
+			acceptWaitGroup.Done()
+		}(l)
+	}
+	acceptWaitGroup.Wait()
+	Trace("Stopped accepting, waiting for handlers")
+	// wait for handlers
+	srv.drain()
+	close(srv.served)
+	return nil
+}
+
+func (srv *Server) acceptLoop(l net.Listener) {
+	var accept = true
+	var delay time.Duration
 	for accept {
-		var c net.Conn
-		if l, ok := srv.listener.(*net.TCPListener); ok {
-			l.SetDeadline(time.Now().Add(3e9))
+		if dl, ok := l.(deadlineListener); ok {
+			dl.SetDeadline(time.Now().Add(3e9))
 		}
-		c, e = srv.listener.Accept()
+		c, e := l.Accept()
 		if e != nil {
-			if ope, ok := e.(*net.OpError); ok {
-				if !(ope.Timeout() && ope.Temporary()) {
-					Error("%s SERVER Accept Error: %v", srv.serverLogPrefix(), ope)
-				}
-			} else {
-				Error("%s SERVER Accept Error: %v", srv.serverLogPrefix(), e)
+			if srv.stopping() {
+				// the listener was closed by StopAccepting
+			} else if !isAcceptTimeout(e) {
+				delay = srv.acceptError(l, e, delay)
 			}
+		} else if acquired, ok := srv.acceptSlot(); !ok {
+			// stopped while waiting for a slot
+			c.Close()
 		} else {
 			//Trace("Handling!")
+			delay = 0
 			srv.handlerWaitGroup.Add(1)
-			go srv.handler(c)
+			srv.trackConn(c)
+			if _, isTLS := c.(*tls.Conn); isTLS {
+				// don't hold back the handshake
+				srv.uncork(c)
+			}
+			go srv.serveConn(c, acquired)
 		}
 		select {
 		case <-srv.stopAccepting:
@@ -176,113 +463,300 @@ func (srv *Server) serve() (e error) {
 		default:
 		}
 	}
-	Trace("Stopped accepting, waiting for handlers")
-	// wait for handlers
-	srv.handlerWaitGroup.Wait()
-	return nil
 }
 
-func (srv *Server) sentinel(c net.Conn, connClosed chan int) {
-	select {
-	case <-srv.stopAccepting:
-		c.SetReadDeadline(time.Now().Add(3 * time.Second))
-	case <-connClosed:
-	}
+// TCP and Unix listeners
+type deadlineListener interface {
+	SetDeadline(t time.Time) error
 }
 
 func (srv *Server) handler(c net.Conn) {
 	startTime := time.Now()
 	bpe := srv.bufferPool.take(c)
 	defer srv.bufferPool.give(bpe)
-	var closeSentinelChan = make(chan int)
-	go srv.sentinel(c, closeSentinelChan)
-	defer srv.connectionFinished(c, closeSentinelChan)
+	defer srv.connectionFinished(c)
 	var err error
 	var req *http.Request
-	// no keepalive (for now)
+	var cancel context.CancelCauseFunc
+	defer func() {
+		// the request's context would outlive a panic
+		if cancel != nil {
+			cancel(nil)
+		}
+	}()
+	defer srv.recoverConn()
 	reqCount := 0
 	keepAlive := true
+	if srv.serveHTTP2TLS(c) {
+		return
+	}
 	for err == nil && keepAlive {
-		if req, err = http.ReadRequest(bpe.br); err == nil {
-			if req.Header.Get("Connection") != "Keep-Alive" {
-				keepAlive = false
-			}
-			request := newRequest(req, c, startTime)
-			reqCount++
-			var res *http.Response
-
-			pssInit := new(PipelineStageStat)
-			pssInit.Name = "server.Init"
-			pssInit.StartTime = startTime
-			pssInit.EndTime = time.Now()
-			request.appendPipelineStage(pssInit)
-			// execute the pipeline
-			if res = srv.Pipeline.execute(request); res == nil {
-				res = SimpleResponse(req, 404, nil, "Not Found")
-			}
-			// cleanup
-			request.startPipelineStage("server.ResponseWrite")
-			req.Body.Close()
-
-			// shutting down?
-			select {
-			case <-srv.stopAccepting:
-				keepAlive = false
-				res.Close = true
-			default:
+		if err = srv.waitForRequest(c, bpe.br, reqCount); err != nil {
+			break
+		}
+		if reqCount == 0 && srv.serveH2C(c, bpe.br) {
+			break
+		}
+		if reqCount > 0 {
+			// Reset the startTime now that the next request is arriving
+			startTime = time.Now()
+		}
+		if req, err = srv.readRequest(bpe); err == nil {
+			var readDeadline time.Time
+			if srv.ReadTimeout > 0 {
+				readDeadline = startTime.Add(srv.ReadTimeout)
 			}
-			// The res.Write omits Content-length on 0 length bodies, and by spec,
-			// it SHOULD. While this is not MUST, it's kinda broken.  See sec 4.4
-			// of rfc2616 and a 200 with a zero length does not satisfy any of the
-			// 5 conditions if Connection: keep-alive is set :(
-			// I'm forcing chunked which seems to work because I couldn't get the
-			// content length to write if it was 0.
-			// Specifically, the android http client waits forever if there's no
-			// content-length instead of assuming zero at the end of headers. der.
-			if res.ContentLength == 0 && len(res.TransferEncoding) == 0 && !((res.StatusCode-100 < 100) || res.StatusCode == 204 || res.StatusCode == 304) {
-				res.TransferEncoding = []string{"identity"}
+			c.SetReadDeadline(readDeadline)
+			if srv.WriteTimeout > 0 {
+				c.SetWriteDeadline(time.Now().Add(srv.WriteTimeout))
 			}
-			if res.ContentLength < 0 {
-				res.TransferEncoding = []string{"chunked"}
+			if srv.upgradeH2C(c, bpe.br, req) {
+				break
 			}
+			cr := srv.newConnRequest(c, req, startTime)
+			cancel = cr.cancel
+			// HTTP/1.1 is persistent unless the client sends Connection: close,
+			// HTTP/1.0 only when it asks for keep-alive.  ReadRequest already
+			// worked this out for us (RFC 7230 section 6.3).
+			keepAlive = !req.Close
+			reqCount++
+			srv.countConnRequest(c)
 
-			// For HTTP/1.0 and Keep-Alive, sending the Connection: Keep-Alive response header is required
-			// because close is default (opposite of 1.1)
-			if keepAlive && !req.ProtoAtLeast(1, 1) {
-				res.Header.Add("Connection", "Keep-Alive")
+			if batch, perr := srv.readPipelined(c, bpe, cr, reqCount); len(batch) > 1 || perr != nil {
+				keepAlive = srv.servePipelined(c, bpe.br, batch, reqCount, perr)
+				reqCount += len(batch) - 1
+				continue
 			}
+			srv.executeConnRequest(c, bpe.br, cr)
+			keepAlive = srv.finishConnRequest(c, bpe.br, cr, keepAlive, reqCount)
+		} else {
+			srv.requestReadFailed(c, err)
+		}
+	}
+	//Debug("%s Processed %v requests on connection %v", srv.serverLogPrefix(), reqCount, c.RemoteAddr())
+}
 
-			// write response
-			if srv.sendfile {
-				res.Write(c)
-				srv.cycleNonBlock(c)
-			} else {
-				wbuf := bufio.NewWriter(c)
-				res.Write(wbuf)
-				wbuf.Flush()
-			}
-			if res.Body != nil {
-				res.Body.Close()
-			}
-			request.finishPipelineStage()
-			request.finishRequest()
-			srv.requestFinished(request)
+// Answers a request over the limits or logs why the request couldn't be
+// read
+func (srv *Server) requestReadFailed(c net.Conn, err error) {
+	if lerr, ok := err.(*limitError); ok {
+		srv.rejectRequest(c, lerr)
+	} else if err != io.EOF && !isTimeout(err) {
+		// EOF is socket closed
+		Error("%s %v ERROR reading request: <%T %v>", srv.serverLogPrefix(), c.RemoteAddr(), err, err)
+	}
+}
 
-			if res.Close {
-				keepAlive = false
-			}
+// A request read from an HTTP/1 connection
+type connRequest struct {
+	req     *http.Request
+	request *Request
+	cancel  context.CancelCauseFunc
+	body    *timeoutReader
+	noBody  bool
+	res     *http.Response
+	// closed once the response is ready if the request runs concurrently
+	done chan int
+}
 
-			// Reset the startTime
-			// this isn't great since there may be lag between requests; but it's the best we've got
-			startTime = time.Now()
+func (srv *Server) newConnRequest(c net.Conn, req *http.Request, startTime time.Time) *connRequest {
+	cr := &connRequest{noBody: req.Body == http.NoBody}
+	cr.req, cr.cancel = srv.requestContext(req)
+	cr.request = newRequest(cr.req, c, startTime)
+	cr.request.srv = srv
+	if srv.ReadTimeout > 0 {
+		cr.body = &timeoutReader{req: cr.request, r: cr.req.Body}
+		cr.req.Body = cr.body
+	}
+	return cr
+}
+
+// Runs the request through the pipeline, cancelling it if the client goes
+// away once the body has been read
+func (srv *Server) executeConnRequest(c net.Conn, br *bufio.Reader, cr *connRequest) {
+	req, request := cr.req, cr.request
+	watcher := srv.newDisconnectWatcher(c, br, cr.cancel)
+	if cr.noBody {
+		// req.Body can be wrapped in a timeoutReader by now
+		watcher.start()
+	} else {
+		req.Body = &eofSignalBody{ReadCloser: req.Body, onEOF: watcher.start}
+	}
+	srv.initStage(request)
+	// execute the pipeline
+	cr.res = srv.execute(request)
+	watcher.stop()
+}
+
+func (srv *Server) initStage(request *Request) {
+	pssInit := new(PipelineStageStat)
+	pssInit.Name = "server.Init"
+	pssInit.StartTime = request.StartTime
+	pssInit.EndTime = time.Now()
+	request.appendPipelineStage(pssInit)
+}
+
+// Writes the response and finishes the request.  Returns whether the
+// connection can be kept alive.  reqCount is the number of requests read
+// from the connection, this one included.
+func (srv *Server) finishConnRequest(c net.Conn, br *bufio.Reader, cr *connRequest, keepAlive bool, reqCount int) bool {
+	req, request, res, body, cancel := cr.req, cr.request, cr.res, cr.body, cr.cancel
+	// cleanup
+	request.startPipelineStage("server.ResponseWrite")
+	if !request.abandonBody() {
+		req.Body.Close()
+	}
+	if request.abandonBody() {
+		// closing gives up on bodies over the limit too
+		keepAlive = false
+	}
+	if body != nil && body.timedOut {
+		// the rest of the body is still on the wire
+		keepAlive = false
+	}
+	if res.Header == nil {
+		res.Header = make(http.Header)
+	}
+	if upgrade := upgradeHandler(res); upgrade != nil {
+		srv.upgradeConn(c, br, request, res, upgrade)
+		cancel(nil)
+		return false
+	}
+
+	// shutting down?
+	select {
+	case <-srv.stopAccepting:
+		keepAlive = false
+		res.Close = true
+	default:
+	}
+	if len(res.Trailer) > 0 {
+		if !req.ProtoAtLeast(1, 1) || res.StatusCode < 200 || res.StatusCode == 204 || res.StatusCode == 304 {
+			res.Trailer = nil
 		} else {
-			// EOF is socket closed
-			if nerr, ok := err.(net.Error); err != io.EOF && !(ok && nerr.Timeout()) {
-				Error("%s %v ERROR reading request: <%T %v>", srv.serverLogPrefix(), c.RemoteAddr(), err, err)
-			}
+			// trailers come after the last chunk
+			res.ContentLength = -1
+		}
+	}
+	// The res.Write omits Content-length on 0 length bodies, and by spec,
+	// it SHOULD. While this is not MUST, it's kinda broken.  See sec 4.4
+	// of rfc2616 and a 200 with a zero length does not satisfy any of the
+	// 5 conditions if Connection: keep-alive is set :(
+	// I'm forcing chunked which seems to work because I couldn't get the
+	// content length to write if it was 0.
+	// Specifically, the android http client waits forever if there's no
+	// content-length instead of assuming zero at the end of headers. der.
+	if res.ContentLength == 0 && len(res.TransferEncoding) == 0 && !((res.StatusCode-100 < 100) || res.StatusCode == 204 || res.StatusCode == 304) {
+		res.TransferEncoding = []string{"identity"}
+	}
+	if res.ContentLength < 0 {
+		res.TransferEncoding = []string{"chunked"}
+	}
+
+	// HTTP/1.0 clients can't read chunked bodies so the only way to
+	// delimit an unknown length body is to close the connection
+	if res.ContentLength < 0 && !req.ProtoAtLeast(1, 1) && req.Method != "HEAD" {
+		res.TransferEncoding = nil
+		keepAlive = false
+	}
+
+	if srv.MaxRequestsPerConn > 0 && reqCount >= srv.MaxRequestsPerConn {
+		keepAlive = false
+	}
+	if res.Close || !keepAlive {
+		keepAlive = false
+		res.Close = true
+	} else if !req.ProtoAtLeast(1, 1) {
+		// For HTTP/1.0 and Keep-Alive, sending the Connection: Keep-Alive response header is required
+		// because close is default (opposite of 1.1)
+		res.Header.Set("Connection", "Keep-Alive")
+	}
+
+	if req.Method == "HEAD" {
+		// the headers are the same as for a GET but Response.Write
+		// leaves the body out.  filters don't need to know.
+		res.Request = req
+	}
+
+	// write response
+	// only plain TCP connections are corked, anything else needs buffering
+	var werr error
+	if stream := streamFunc(res); stream != nil {
+		werr = srv.writeStream(c, res, stream)
+	} else if _, isTCP := c.(*net.TCPConn); srv.sendfile && isTCP {
+		werr = res.Write(c)
+	} else {
+		wbuf := bufio.NewWriter(c)
+		if werr = res.Write(wbuf); werr == nil {
+			werr = wbuf.Flush()
+		}
+	}
+	srv.cycleNonBlock(c)
+	if res.Body != nil {
+		res.Body.Close()
+	}
+	if werr != nil {
+		if isTimeout(werr) {
+			request.CurrentStage.Status = StatusTimeout
+		}
+		keepAlive = false
+	}
+	if srv.stopping() {
+		// a stream can outlive the start of a shutdown
+		keepAlive = false
+	}
+	cancel(nil)
+	request.finishPipelineStage()
+	request.finishRequest()
+	srv.requestFinished(request)
+	return keepAlive
+}
+
+// Waits for the next request on the connection to start arriving and sets
+// the read deadline for it.  Keep-alive connections wait up to IdleTimeout.
+func (srv *Server) waitForRequest(c net.Conn, br *bufio.Reader, reqCount int) error {
+	timeout := srv.ReadHeaderTimeout
+	if timeout == 0 {
+		timeout = srv.ReadTimeout
+	}
+	if reqCount > 0 {
+		var idleDeadline time.Time
+		if srv.IdleTimeout > 0 {
+			idleDeadline = time.Now().Add(srv.IdleTimeout)
+		}
+		c.SetReadDeadline(idleDeadline)
+		srv.setConnState(c, ConnIdle)
+	} else if timeout > 0 {
+		c.SetReadDeadline(time.Now().Add(timeout))
+	}
+	if _, err := br.Peek(1); err != nil {
+		return err
+	}
+	srv.setConnState(c, ConnActive)
+	if timeout > 0 {
+		c.SetReadDeadline(time.Now().Add(timeout))
+	} else if reqCount > 0 && srv.IdleTimeout > 0 {
+		c.SetReadDeadline(time.Time{})
+	}
+	return nil
+}
+
+// Finds the TCP connection under any TLS or PROXY protocol wrapping
+func tcpConn(c net.Conn) *net.TCPConn {
+	for {
+		switch wc := c.(type) {
+		case *net.TCPConn:
+			return wc
+		case *tls.Conn:
+			c = wc.NetConn()
+		case *proxyConn:
+			c = wc.Conn
+		case *bufferedConn:
+			c = wc.Conn
+		default:
+			return nil
 		}
 	}
-	//Debug("%s Processed %v requests on connection %v", srv.serverLogPrefix(), reqCount, c.RemoteAddr())
 }
 
 func (srv *Server) serverLogPrefix() string {
@@ -292,12 +766,19 @@ func (srv *Server) serverLogPrefix() string {
 func (srv *Server) requestFinished(request *Request) {
 	if srv.Pipeline.RequestDoneCallback != nil {
 		// Don't block the connecion for this
-		go srv.Pipeline.RequestDoneCallback.FilterRequest(request)
+		go func() {
+			defer func() {
+				if v := recover(); v != nil {
+					request.logPanic("RequestDoneCallback", v)
+				}
+			}()
+			srv.Pipeline.RequestDoneCallback.FilterRequest(request)
+		}()
 	}
 }
 
-func (srv *Server) connectionFinished(c net.Conn, closeChan chan int) {
+func (srv *Server) connectionFinished(c net.Conn) {
 	c.Close()
-	close(closeChan)
+	srv.untrackConn(c)
 	srv.handlerWaitGroup.Done()
 }
@@ -4,20 +4,40 @@ package falcore
 
 import (
 	"net"
+	"os"
 	"syscall"
 )
 
 // only valid on non-windows
-func (srv *Server) setupNonBlockingListener(err error, l *net.TCPListener) error {
+// Returns a copy of the listener's socket for passing to a child process,
+// along with its fd.  Callers have to use the returned fd.  Calling Fd()
+// on the file again would put the socket back into blocking mode.
+func (srv *Server) setupNonBlockingListener(l net.Listener) (f *os.File, fd int, err error) {
 	// FIXME: File() returns a copied pointer.  we're leaking it.  probably doesn't matter
-	if srv.listenerFile, err = l.File(); err != nil {
-		return err
+	switch nl := l.(type) {
+	case *net.TCPListener:
+		f, err = nl.File()
+	case *net.UnixListener:
+		f, err = nl.File()
 	}
-	fd := int(srv.listenerFile.Fd())
+	if err != nil || f == nil {
+		return nil, -1, err
+	}
+	fd = int(f.Fd())
+	_, isTCP := l.(*net.TCPListener)
+	if err = srv.setupNonBlockingFd(fd, isTCP); err != nil {
+		return nil, -1, err
+	}
+	return f, fd, nil
+}
+
+// Puts a listening socket into non-blocking mode and sets the options
+// sendfile needs on TCP sockets
+func (srv *Server) setupNonBlockingFd(fd int, isTCP bool) error {
 	if e := syscall.SetNonblock(fd, true); e != nil {
 		return e
 	}
-	if srv.sendfile {
+	if isTCP && srv.sendfile {
 		if e := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, srv.sockOpt, 1); e != nil {
 			return e
 		}
@@ -27,7 +47,7 @@ func (srv *Server) setupNonBlockingListener(err error, l *net.TCPListener) error
 
 func (srv *Server) cycleNonBlock(c net.Conn) {
 	if srv.sendfile {
-		if tcpC, ok := c.(*net.TCPConn); ok {
+		if tcpC := tcpConn(c); tcpC != nil {
 			if f, err := tcpC.File(); err == nil {
 				// f is a copy.  must be closed
 				defer f.Close()
@@ -43,3 +63,19 @@ func (srv *Server) cycleNonBlock(c net.Conn) {
 		}
 	}
 }
+
+// Turns TCP_CORK/TCP_NOPUSH off for connections that don't write whole
+// responses at once, like TLS handshakes and HTTP/2.  cycleNonBlock turns
+// it back on.
+func (srv *Server) uncork(c net.Conn) {
+	if !srv.sendfile {
+		return
+	}
+	if tcpC := tcpConn(c); tcpC != nil {
+		if rc, err := tcpC.SyscallConn(); err == nil {
+			rc.Control(func(fd uintptr) {
+				syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, srv.sockOpt, 0)
+			})
+		}
+	}
+}
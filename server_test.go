@@ -0,0 +1,289 @@
+package falcore
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func helloFilter(req *Request) *http.Response {
+	return SimpleResponse(req.HttpRequest, 200, nil, "hello")
+}
+
+// Creates a server listening on a random port with a single filter
+func newTestServer(t *testing.T, filter func(req *Request) *http.Response) *Server {
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(NewRequestFilter(filter))
+	srv := NewServer(0, pipeline)
+	if err := srv.socketListen(); err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	return srv
+}
+
+// Runs the server in the background and waits until it's accepting
+func startTestServer(srv *Server) {
+	go srv.ListenAndServe()
+	<-srv.AcceptReady
+}
+
+func dialTestServer(t *testing.T, srv *Server) (net.Conn, *bufio.Reader) {
+	c, err := net.Dial("tcp", fmt.Sprintf("localhost:%v", srv.Port()))
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	return c, bufio.NewReader(c)
+}
+
+// Writes a raw request and reads the response along with its body
+func roundTrip(t *testing.T, c net.Conn, br *bufio.Reader, raw string) (*http.Response, string) {
+	if _, err := io.WriteString(c, raw); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("Read response failed: %v", err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	return res, string(body)
+}
+
+// Reports whether the server closed the connection
+func connClosed(c net.Conn, br *bufio.Reader) bool {
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err := br.ReadByte()
+	return err == io.EOF
+}
+
+var keepAliveTests = []struct {
+	name      string
+	request   string
+	keepAlive bool
+}{
+	{"HTTP/1.1 default", "GET / HTTP/1.1\r\nHost: test\r\n\r\n", true},
+	{"HTTP/1.1 close", "GET / HTTP/1.1\r\nHost: test\r\nConnection: close\r\n\r\n", false},
+	{"HTTP/1.1 close token", "GET / HTTP/1.1\r\nHost: test\r\nConnection: TE, Close\r\n\r\n", false},
+	{"HTTP/1.0 default", "GET / HTTP/1.0\r\n\r\n", false},
+	{"HTTP/1.0 keep-alive", "GET / HTTP/1.0\r\nConnection: keep-alive\r\n\r\n", true},
+}
+
+func TestServerKeepAlive(t *testing.T) {
+	srv := newTestServer(t, helloFilter)
+	startTestServer(srv)
+	defer srv.StopAccepting()
+
+	for _, test := range keepAliveTests {
+		c, br := dialTestServer(t, srv)
+		res, body := roundTrip(t, c, br, test.request)
+		if body != "hello" {
+			t.Errorf("%v: Body mismatch: %q", test.name, body)
+		}
+		if res.Close == test.keepAlive {
+			t.Errorf("%v: Response close was %v", test.name, res.Close)
+		}
+		if test.keepAlive {
+			// the connection must still be usable
+			if _, body = roundTrip(t, c, br, test.request); body != "hello" {
+				t.Errorf("%v: Second body mismatch: %q", test.name, body)
+			}
+		} else if !connClosed(c, br) {
+			t.Errorf("%v: Connection was not closed", test.name)
+		}
+		c.Close()
+	}
+}
+
+func TestServerMaxRequestsPerConn(t *testing.T) {
+	srv := newTestServer(t, helloFilter)
+	srv.MaxRequestsPerConn = 2
+	startTestServer(srv)
+	defer srv.StopAccepting()
+
+	c, br := dialTestServer(t, srv)
+	defer c.Close()
+	request := "GET / HTTP/1.1\r\nHost: test\r\n\r\n"
+	if res, _ := roundTrip(t, c, br, request); res.Close {
+		t.Errorf("First response should keep the connection open")
+	}
+	if res, _ := roundTrip(t, c, br, request); !res.Close {
+		t.Errorf("Last response should close the connection")
+	}
+	if !connClosed(c, br) {
+		t.Errorf("Connection was not closed after MaxRequestsPerConn")
+	}
+}
+
+func TestServerIdleTimeout(t *testing.T) {
+	srv := newTestServer(t, helloFilter)
+	srv.IdleTimeout = 50 * time.Millisecond
+	startTestServer(srv)
+	defer srv.StopAccepting()
+
+	c, br := dialTestServer(t, srv)
+	defer c.Close()
+	roundTrip(t, c, br, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+	if !connClosed(c, br) {
+		t.Errorf("Idle connection was not closed")
+	}
+}
+
+func TestServerReadHeaderTimeout(t *testing.T) {
+	srv := newTestServer(t, helloFilter)
+	srv.ReadHeaderTimeout = 50 * time.Millisecond
+	startTestServer(srv)
+	defer srv.StopAccepting()
+
+	c, br := dialTestServer(t, srv)
+	defer c.Close()
+	io.WriteString(c, "GET / HTTP/1.1\r\nHost: te")
+	if !connClosed(c, br) {
+		t.Errorf("Slow header connection was not closed")
+	}
+}
+
+func TestServerReadTimeout(t *testing.T) {
+	srv := newTestServer(t, func(req *Request) *http.Response {
+		ioutil.ReadAll(req.HttpRequest.Body)
+		return SimpleResponse(req.HttpRequest, 200, nil, "hello")
+	})
+	srv.ReadTimeout = 50 * time.Millisecond
+	done := make(chan *Request, 1)
+	srv.Pipeline.RequestDoneCallback = NewRequestFilter(func(req *Request) *http.Response {
+		done <- req
+		return nil
+	})
+	startTestServer(srv)
+	defer srv.StopAccepting()
+
+	c, br := dialTestServer(t, srv)
+	defer c.Close()
+	res, _ := roundTrip(t, c, br, "POST / HTTP/1.1\r\nHost: test\r\nContent-Length: 10\r\n\r\nab")
+	if !res.Close {
+		t.Errorf("Connection should close after a body read timeout")
+	}
+	req := <-done
+	var statuses []PipelineStatus
+	for e := req.PipelineStageStats.Front(); e != nil; e = e.Next() {
+		statuses = append(statuses, e.Value.(*PipelineStageStat).Status)
+	}
+	if len(statuses) != 3 || statuses[1] != StatusTimeout {
+		t.Errorf("Filter stage not marked as timed out: %v", statuses)
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	release := make(chan int)
+	srv := newTestServer(t, func(req *Request) *http.Response {
+		if req.HttpRequest.URL.Path == "/slow" {
+			<-release
+		}
+		return SimpleResponse(req.HttpRequest, 200, nil, "hello")
+	})
+	served := make(chan error)
+	go func() {
+		served <- srv.ListenAndServe()
+	}()
+	<-srv.AcceptReady
+
+	// one idle keep-alive connection and one with a request in flight
+	idle, idleBr := dialTestServer(t, srv)
+	defer idle.Close()
+	roundTrip(t, idle, idleBr, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+	busy, busyBr := dialTestServer(t, srv)
+	defer busy.Close()
+	io.WriteString(busy, "GET /slow HTTP/1.1\r\nHost: test\r\n\r\n")
+	for active, _ := srv.Connections(); active != 1; active, _ = srv.Connections() {
+		time.Sleep(time.Millisecond)
+	}
+
+	statusChan := make(chan ShutdownStatus)
+	go func() {
+		statusChan <- srv.Shutdown(time.Now().Add(5 * time.Second))
+	}()
+	if !connClosed(idle, idleBr) {
+		t.Errorf("Idle connection was not closed")
+	}
+	close(release)
+	busy.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if res, err := http.ReadResponse(busyBr, nil); err != nil || !res.Close {
+		t.Errorf("In flight request should finish with Connection: close: %v", err)
+	}
+	status := <-statusChan
+	if status.Drained != 1 || status.Idle != 1 || status.Killed != 0 {
+		t.Errorf("Unexpected shutdown status: %+v", status)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("ListenAndServe returned %v", err)
+	}
+}
+
+func TestServerShutdownDeadline(t *testing.T) {
+	release := make(chan int)
+	defer close(release)
+	srv := newTestServer(t, func(req *Request) *http.Response {
+		<-release
+		return SimpleResponse(req.HttpRequest, 200, nil, "hello")
+	})
+	startTestServer(srv)
+
+	c, br := dialTestServer(t, srv)
+	defer c.Close()
+	io.WriteString(c, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+	// a connection that hasn't sent anything isn't busy
+	fresh, _ := dialTestServer(t, srv)
+	defer fresh.Close()
+	for active, idle := srv.Connections(); active != 1 || idle != 1; active, idle = srv.Connections() {
+		time.Sleep(time.Millisecond)
+	}
+
+	status := srv.Shutdown(time.Now().Add(50 * time.Millisecond))
+	if status.Killed != 1 || status.Idle != 1 {
+		t.Errorf("Expected the straggler killed and the new connection idle: %+v", status)
+	}
+	if !connClosed(c, br) {
+		t.Errorf("Killed connection is still open")
+	}
+}
+
+func TestServerMultipleListeners(t *testing.T) {
+	srv := newTestServer(t, func(req *Request) *http.Response {
+		return SimpleResponse(req.HttpRequest, 200, nil, req.Connection.LocalAddr().Network())
+	})
+	sock := fmt.Sprintf("%v/falcore_test_%v.sock", os.TempDir(), os.Getpid())
+	defer os.Remove(sock)
+	if err := srv.Listen("unix", sock); err != nil {
+		t.Fatalf("Could not listen on unix socket: %v", err)
+	}
+	if len(srv.Addrs()) != 2 || len(srv.SocketFds()) != 2 {
+		t.Fatalf("Expected 2 listeners: %v", srv.Addrs())
+	}
+	startTestServer(srv)
+	defer srv.StopAccepting()
+
+	c, br := dialTestServer(t, srv)
+	defer c.Close()
+	if _, body := roundTrip(t, c, br, "GET / HTTP/1.1\r\nHost: test\r\n\r\n"); body != "tcp" {
+		t.Errorf("Expected request on tcp: %q", body)
+	}
+	uc, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatalf("Could not connect to unix socket: %v", err)
+	}
+	defer uc.Close()
+	if _, body := roundTrip(t, uc, bufio.NewReader(uc), "GET / HTTP/1.1\r\nHost: test\r\n\r\n"); body != "unix" {
+		t.Errorf("Expected request on unix: %q", body)
+	}
+
+	// in use by this server
+	if err := NewServer(0, nil).Listen("unix", sock); err == nil {
+		t.Errorf("Listen should fail on a socket that's in use")
+	}
+}
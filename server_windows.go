@@ -3,13 +3,22 @@ package falcore
 
 import (
 	"net"
+	"os"
 )
 
 // only valid on non-windows
-func (srv *Server) setupNonBlockingListener(err error, l *net.TCPListener) error {
+func (srv *Server) setupNonBlockingListener(l net.Listener) (*os.File, int, error) {
+	return nil, -1, nil
+}
+
+func (srv *Server) setupNonBlockingFd(fd int, isTCP bool) error {
 	return nil
 }
 
 func (srv *Server) cycleNonBlock(c net.Conn) {
 	// nuthin
 }
+
+func (srv *Server) uncork(c net.Conn) {
+	// nuthin
+}
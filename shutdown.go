@@ -0,0 +1,194 @@
+package falcore
+
+import (
+	"net"
+	"time"
+)
+
+// How a connection was closed during shutdown
+const (
+	closedNormally = iota
+	closedIdle
+	closedKilled
+)
+
+// During shutdown, connections that have been open this long without
+// sending a request are treated as idle.
+const newConnGracePeriod = 3 * time.Second
+
+// How long Shutdown waits for the connections it closed at the deadline to
+// be cleaned up before counting them
+const shutdownKillWait = 100 * time.Millisecond
+
+// Book keeping for an open connection
+type connInfo struct {
+	state    ConnState
+	changed  time.Time
+	closed   int
+	requests int
+}
+
+// Returned from Server.Shutdown with a count of how each connection
+// that was open during shutdown ended.
+type ShutdownStatus struct {
+	// Connections that finished their in-flight request and closed
+	Drained int
+	// Keep-alive connections that were closed while waiting for a request
+	Idle int
+	// Connections that were still busy at the deadline and were force closed
+	Killed int
+}
+
+// Stops accepting new connections and waits for the open ones to finish.
+// Idle keep-alive connections are closed immediately and requests that are
+// in flight are answered with Connection: close.  Any connection still open
+// at the deadline is force closed.  Note that this doesn't stop filters that
+// are still running on a killed connection.
+func (srv *Server) Shutdown(deadline time.Time) ShutdownStatus {
+	srv.StopAccepting()
+	timer := time.NewTimer(deadline.Sub(time.Now()))
+	defer timer.Stop()
+	select {
+	case <-srv.served:
+	case <-timer.C:
+		srv.cancelCtx()
+		srv.closeConns(false)
+		// the handlers of the idle ones are about to return.  killed
+		// ones might not if their filters don't notice.
+		wait := time.NewTimer(shutdownKillWait)
+		select {
+		case <-srv.served:
+		case <-wait.C:
+		}
+		wait.Stop()
+	}
+	srv.connMutex.Lock()
+	status := srv.shutdownStatus
+	srv.connMutex.Unlock()
+	if status.Killed > 0 {
+		Warn("%s SERVER Shutdown deadline passed.  Killed %d connections", srv.serverLogPrefix(), status.Killed)
+	}
+	return status
+}
+
+// The number of open connections that are serving a request and
+// the number that are idle.  New connections count as idle.
+func (srv *Server) Connections() (active, idle int) {
+	srv.connMutex.Lock()
+	defer srv.connMutex.Unlock()
+	for _, info := range srv.conns {
+		if info.state == ConnActive || info.state == ConnHijacked {
+			active++
+		} else {
+			idle++
+		}
+	}
+	return
+}
+
+func (srv *Server) stopping() bool {
+	select {
+	case <-srv.stopAccepting:
+		return true
+	default:
+	}
+	return false
+}
+
+func (srv *Server) trackConn(c net.Conn) {
+	srv.connMutex.Lock()
+	srv.conns[c] = &connInfo{state: ConnNew, changed: time.Now()}
+	srv.connMutex.Unlock()
+}
+
+func (srv *Server) setConnState(c net.Conn, state ConnState) {
+	srv.connMutex.Lock()
+	info, ok := srv.conns[c]
+	var requests int
+	if ok {
+		info.state = state
+		info.changed = time.Now()
+		requests = info.requests
+	}
+	srv.connMutex.Unlock()
+	if ok {
+		srv.connStateChanged(c, state, requests)
+	}
+}
+
+// Counts a request read from the connection
+func (srv *Server) countConnRequest(c net.Conn) {
+	srv.connMutex.Lock()
+	if info, ok := srv.conns[c]; ok {
+		info.requests++
+	}
+	srv.connMutex.Unlock()
+}
+
+func (srv *Server) untrackConn(c net.Conn) {
+	srv.connMutex.Lock()
+	info, ok := srv.conns[c]
+	if !ok {
+		srv.connMutex.Unlock()
+		return
+	}
+	delete(srv.conns, c)
+	if srv.stopping() {
+		switch info.closed {
+		case closedNormally:
+			srv.shutdownStatus.Drained++
+		case closedIdle:
+			srv.shutdownStatus.Idle++
+		}
+	}
+	requests := info.requests
+	srv.connMutex.Unlock()
+	srv.connStateChanged(c, ConnClosed, requests)
+}
+
+// Closes idle connections if idleOnly is set, otherwise every open
+// connection.  Returns the number closed.
+func (srv *Server) closeConns(idleOnly bool) (count int) {
+	srv.connMutex.Lock()
+	defer srv.connMutex.Unlock()
+	now := time.Now()
+	for c, info := range srv.conns {
+		if info.closed != closedNormally {
+			continue
+		}
+		switch {
+		case info.state == ConnIdle:
+			info.closed = closedIdle
+		case info.state == ConnNew && (!idleOnly || now.Sub(info.changed) > newConnGracePeriod):
+			// at the deadline new connections are idle too, not busy
+			info.closed = closedIdle
+		case !idleOnly:
+			info.closed = closedKilled
+			srv.shutdownStatus.Killed++
+		default:
+			continue
+		}
+		c.Close()
+		count++
+	}
+	return
+}
+
+// Waits for all the handlers to finish, closing connections as they go idle
+func (srv *Server) drain() {
+	done := make(chan int)
+	go func() {
+		srv.handlerWaitGroup.Wait()
+		close(done)
+	}()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		srv.closeConns(true)
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
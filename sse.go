@@ -0,0 +1,148 @@
+package falcore
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Server-Sent Event.  See
+// https://html.spec.whatwg.org/multipage/server-sent-events.html
+type SSEEvent struct {
+	ID    string
+	Event string
+	Data  string
+	// How long the client should wait before reconnecting.  Zero leaves
+	// it alone.
+	Retry time.Duration
+}
+
+// Writes events to an SSEResponse
+type SSEWriter struct {
+	*StreamWriter
+	// The Last-Event-ID the client sent when reconnecting or empty
+	LastEventID string
+
+	closing   chan int
+	closeOnce sync.Once
+}
+
+// Writes and flushes an event
+func (sse *SSEWriter) Send(ev *SSEEvent) error {
+	var b bytes.Buffer
+	if ev.ID != "" {
+		fmt.Fprintf(&b, "id: %v\n", sseField(ev.ID))
+	}
+	if ev.Event != "" {
+		fmt.Fprintf(&b, "event: %v\n", sseField(ev.Event))
+	}
+	if ev.Retry > 0 {
+		fmt.Fprintf(&b, "retry: %v\n", int64(ev.Retry/time.Millisecond))
+	}
+	data := strings.Replace(strings.Replace(ev.Data, "\r\n", "\n", -1), "\r", "\n", -1)
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(&b, "data: %v\n", line)
+	}
+	b.WriteByte('\n')
+	if _, err := sse.Write(b.Bytes()); err != nil {
+		return err
+	}
+	return sse.Flush()
+}
+
+// Writes and flushes a comment.  Clients ignore these.
+func (sse *SSEWriter) Comment(text string) error {
+	if _, err := fmt.Fprintf(sse, ": %v\n\n", sseField(text)); err != nil {
+		return err
+	}
+	return sse.Flush()
+}
+
+// Closed when the Server starts shutting down or a heartbeat couldn't be
+// sent because the client went away.  The stream should return.
+func (sse *SSEWriter) Closing() <-chan int {
+	return sse.closing
+}
+
+func (sse *SSEWriter) close() {
+	sse.closeOnce.Do(func() {
+		close(sse.closing)
+	})
+}
+
+func (sse *SSEWriter) heartbeat(interval time.Duration, done chan int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-sse.StreamWriter.Closing():
+			sse.close()
+			return
+		case <-ticker.C:
+			if err := sse.Comment("heartbeat"); err != nil {
+				sse.close()
+				return
+			}
+		}
+	}
+}
+
+// Ids, event names and comments can't span lines
+func sseField(s string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(s)
+}
+
+// Streams Server-Sent Events (text/event-stream) from stream.  With a
+// heartbeat a comment is sent at that interval so proxies don't drop
+// quiet streams and clients that went away are noticed.  stream should
+// return once SSEWriter.Closing is closed so that Shutdown can finish.
+//
+//	return falcore.SSEResponse(req.HttpRequest, 15*time.Second, func(sse *falcore.SSEWriter) error {
+//	    for {
+//	        select {
+//	        case msg := <-messages:
+//	            if err := sse.Send(&falcore.SSEEvent{Data: msg}); err != nil {
+//	                return err
+//	            }
+//	        case <-sse.Closing():
+//	            return nil
+//	        }
+//	    }
+//	})
+func SSEResponse(req *http.Request, heartbeat time.Duration, stream func(sse *SSEWriter) error) *http.Response {
+	headers := make(http.Header)
+	headers.Set("Content-Type", "text/event-stream")
+	headers.Set("Cache-Control", "no-cache")
+	return StreamResponse(req, 200, headers, func(w *StreamWriter) error {
+		sse := &SSEWriter{
+			StreamWriter: w,
+			LastEventID:  req.Header.Get("Last-Event-ID"),
+			closing:      make(chan int),
+		}
+		// a heartbeat that's already started has to finish before the
+		// response is ended
+		var wg sync.WaitGroup
+		done := make(chan int)
+		defer wg.Wait()
+		defer close(done)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if heartbeat > 0 {
+				sse.heartbeat(heartbeat, done)
+				return
+			}
+			select {
+			case <-done:
+			case <-w.Closing():
+				sse.close()
+			}
+		}()
+		return stream(sse)
+	})
+}
@@ -0,0 +1,191 @@
+package falcore
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Writes a streaming response body.  Nothing is sent until Flush is
+// called or the buffer fills, so call Flush whenever the client should
+// see what's been written so far.
+//
+// WriteTimeout applies to each Flush instead of the whole response.
+// Writes from goroutines that outlive the StreamFunc fail.
+type StreamWriter struct {
+	w        io.Writer
+	flush    func() error
+	closing  <-chan int
+	deadline func()
+	trailer  http.Header
+	mutex    sync.Mutex
+	finished bool
+}
+
+// Returned by writes from goroutines that outlive their StreamFunc
+var errStreamFinished = errors.New("falcore: stream already finished")
+
+func (sw *StreamWriter) Write(p []byte) (int, error) {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+	if sw.finished {
+		return 0, errStreamFinished
+	}
+	return sw.w.Write(p)
+}
+
+// Sends everything written so far to the client
+func (sw *StreamWriter) Flush() error {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+	if sw.finished {
+		return errStreamFinished
+	}
+	return sw.flushLocked()
+}
+
+func (sw *StreamWriter) flushLocked() error {
+	if sw.deadline != nil {
+		sw.deadline()
+	}
+	return sw.flush()
+}
+
+// Trailers sent after the body once the StreamFunc returns.  Names
+// already in the response's Trailer are announced in the header.  HTTP/1.0
+// clients don't get trailers.
+func (sw *StreamWriter) Trailer() http.Header {
+	return sw.trailer
+}
+
+// Closed when the Server starts shutting down.  Long lived streams should
+// finish up and return.
+func (sw *StreamWriter) Closing() <-chan int {
+	return sw.closing
+}
+
+// Writes the body of a streaming response.  The response is finished
+// when it returns.  An error means the response is incomplete and the
+// connection is closed without properly ending the body.
+type StreamFunc func(w *StreamWriter) error
+
+// Returns a response whose body is written by stream as it runs instead
+// of being read from res.Body.  HTTP/1.1 clients get a chunked body.
+// HTTP/1.0 clients get the body until the connection is closed.
+//
+// Response filters can change the headers but shouldn't replace the Body.
+func StreamResponse(req *http.Request, status int, headers http.Header, stream StreamFunc) *http.Response {
+	res := new(http.Response)
+	res.StatusCode = status
+	res.ProtoMajor = 1
+	res.ProtoMinor = 1
+	res.ContentLength = -1
+	res.Request = req
+	res.Header = make(http.Header)
+	if headers != nil {
+		res.Header = headers
+	}
+	res.Body = &streamBody{stream: stream}
+	return res
+}
+
+// An empty body that carries the StreamFunc through the pipeline
+type streamBody struct {
+	stream StreamFunc
+}
+
+func (b *streamBody) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (b *streamBody) Close() error {
+	return nil
+}
+
+// The StreamFunc if res is a streaming response
+func streamFunc(res *http.Response) StreamFunc {
+	if sb, ok := res.Body.(*streamBody); ok {
+		return sb.stream
+	}
+	return nil
+}
+
+// Writes the headers and runs the stream.  The socket is left uncorked so
+// each Flush goes straight out.
+func (srv *Server) writeStream(c net.Conn, res *http.Response, stream StreamFunc) error {
+	srv.uncork(c)
+	w := bufio.NewWriter(c)
+	chunked := len(res.TransferEncoding) > 0 && res.TransferEncoding[0] == "chunked"
+	if res.Trailer == nil {
+		res.Trailer = make(http.Header)
+	}
+	if err := writeStreamHeader(w, res, chunked); err != nil {
+		return err
+	}
+	if res.Request != nil && res.Request.Method == "HEAD" {
+		return w.Flush()
+	}
+
+	sw := &StreamWriter{w: w, flush: w.Flush, closing: srv.stopAccepting, trailer: res.Trailer}
+	if srv.WriteTimeout > 0 {
+		sw.deadline = func() {
+			c.SetWriteDeadline(time.Now().Add(srv.WriteTimeout))
+		}
+	}
+	var cw io.WriteCloser
+	if chunked {
+		cw = httputil.NewChunkedWriter(w)
+		sw.w = cw
+	}
+	// the client gets the headers right away
+	if err := sw.Flush(); err != nil {
+		return err
+	}
+	err := stream(sw)
+	// nothing can be written after the end of the body
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+	sw.finished = true
+	if err != nil {
+		return err
+	}
+	if cw != nil {
+		cw.Close()
+		sw.trailer.Write(w)
+		io.WriteString(w, "\r\n")
+	}
+	return sw.flushLocked()
+}
+
+// Response.Write can't do this without a body to read from
+func writeStreamHeader(w *bufio.Writer, res *http.Response, chunked bool) error {
+	fmt.Fprintf(w, "HTTP/%d.%d %03d %s\r\n", res.ProtoMajor, res.ProtoMinor, res.StatusCode, http.StatusText(res.StatusCode))
+	res.Header.Del("Content-Length")
+	if chunked {
+		res.Header.Set("Transfer-Encoding", "chunked")
+		if len(res.Trailer) > 0 {
+			names := make([]string, 0, len(res.Trailer))
+			for k := range res.Trailer {
+				names = append(names, k)
+			}
+			sort.Strings(names)
+			res.Header.Set("Trailer", strings.Join(names, ", "))
+		}
+	}
+	if res.Close {
+		res.Header.Set("Connection", "close")
+	}
+	if err := res.Header.Write(w); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
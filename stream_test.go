@@ -0,0 +1,160 @@
+package falcore
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestServerStreamResponse(t *testing.T) {
+	release := make(chan int)
+	srv := newTestServer(t, func(req *Request) *http.Response {
+		if req.HttpRequest.URL.Path != "/stream" {
+			return SimpleResponse(req.HttpRequest, 200, nil, "hello")
+		}
+		return StreamResponse(req.HttpRequest, 200, nil, func(w *StreamWriter) error {
+			io.WriteString(w, "first ")
+			if err := w.Flush(); err != nil {
+				return err
+			}
+			<-release
+			io.WriteString(w, "second")
+			return nil
+		})
+	})
+	startTestServer(srv)
+	defer srv.StopAccepting()
+
+	c, br := dialTestServer(t, srv)
+	defer c.Close()
+	io.WriteString(c, "GET /stream HTTP/1.1\r\nHost: test\r\n\r\n")
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("Read response failed: %v", err)
+	}
+	if len(res.TransferEncoding) == 0 || res.TransferEncoding[0] != "chunked" {
+		t.Errorf("Expected a chunked stream: %v", res.TransferEncoding)
+	}
+	// the flushed part arrives before the stream finishes
+	first := make([]byte, 6)
+	if _, err := io.ReadFull(res.Body, first); err != nil || string(first) != "first " {
+		t.Errorf("Expected the flushed chunk: %q %v", first, err)
+	}
+	close(release)
+	if rest, _ := ioutil.ReadAll(res.Body); string(rest) != "second" {
+		t.Errorf("Expected the rest of the stream: %q", rest)
+	}
+
+	// the connection is still good
+	if _, body := roundTrip(t, c, br, "GET / HTTP/1.1\r\nHost: test\r\n\r\n"); body != "hello" {
+		t.Errorf("Expected keep-alive after a stream: %q", body)
+	}
+
+	// HTTP/1.0 gets the body until close
+	c10, br10 := dialTestServer(t, srv)
+	defer c10.Close()
+	if res, body := roundTrip(t, c10, br10, "GET /stream HTTP/1.0\r\n\r\n"); len(res.TransferEncoding) > 0 || body != "first second" {
+		t.Errorf("Expected an unchunked HTTP/1.0 stream: %v %q", res.TransferEncoding, body)
+	}
+}
+
+func TestServerStreamLateWrite(t *testing.T) {
+	late := make(chan error, 1)
+	srv := newTestServer(t, func(req *Request) *http.Response {
+		if req.HttpRequest.URL.Path != "/stream" {
+			return SimpleResponse(req.HttpRequest, 200, nil, "hello")
+		}
+		return StreamResponse(req.HttpRequest, 200, nil, func(w *StreamWriter) error {
+			returned := make(chan int)
+			go func() {
+				<-returned
+				// give writeStream time to end the body
+				time.Sleep(50 * time.Millisecond)
+				_, err := io.WriteString(w, "late")
+				late <- err
+			}()
+			io.WriteString(w, "body")
+			close(returned)
+			return nil
+		})
+	})
+	startTestServer(srv)
+	defer srv.StopAccepting()
+
+	c, br := dialTestServer(t, srv)
+	defer c.Close()
+	if _, body := roundTrip(t, c, br, "GET /stream HTTP/1.1\r\nHost: test\r\n\r\n"); body != "body" {
+		t.Errorf("Expected the stream: %q", body)
+	}
+	if err := <-late; err != errStreamFinished {
+		t.Errorf("Expected the late write to fail got %v", err)
+	}
+	// nothing got in after the end of the chunked body
+	if _, body := roundTrip(t, c, br, "GET / HTTP/1.1\r\nHost: test\r\n\r\n"); body != "hello" {
+		t.Errorf("Expected keep-alive after the stream: %q", body)
+	}
+}
+
+func TestServerSSE(t *testing.T) {
+	srv := newTestServer(t, func(req *Request) *http.Response {
+		return SSEResponse(req.HttpRequest, 10*time.Millisecond, func(sse *SSEWriter) error {
+			sse.Send(&SSEEvent{ID: "2", Event: "update", Data: "line1\nline2", Retry: time.Second})
+			sse.Send(&SSEEvent{Data: "resumed after " + sse.LastEventID})
+			<-sse.Closing()
+			return sse.Send(&SSEEvent{Event: "bye"})
+		})
+	})
+	served := make(chan error)
+	go func() {
+		served <- srv.ListenAndServe()
+	}()
+	<-srv.AcceptReady
+
+	c, br := dialTestServer(t, srv)
+	defer c.Close()
+	io.WriteString(c, "GET /events HTTP/1.1\r\nHost: test\r\nLast-Event-ID: 1\r\n\r\n")
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("Read response failed: %v", err)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Bad content type %v", ct)
+	}
+	events := bufio.NewReader(res.Body)
+	expected := []string{
+		"id: 2\n", "event: update\n", "retry: 1000\n", "data: line1\n", "data: line2\n", "\n",
+		"data: resumed after 1\n", "\n",
+	}
+	for _, e := range expected {
+		if line, _ := events.ReadString('\n'); line != e {
+			t.Errorf("Expected %q got %q", e, line)
+		}
+	}
+	if line, _ := events.ReadString('\n'); line != ": heartbeat\n" {
+		t.Errorf("Expected a heartbeat got %q", line)
+	}
+
+	// shutdown ends the stream cleanly
+	status := srv.Shutdown(time.Now().Add(5 * time.Second))
+	if status.Killed != 0 || status.Drained != 1 {
+		t.Errorf("Expected the stream to drain: %+v", status)
+	}
+	if rest, err := ioutil.ReadAll(events); err != nil || !bytesContain(rest, "event: bye\n") {
+		t.Errorf("Expected the last event and a clean end: %q %v", rest, err)
+	}
+	<-served
+}
+
+func bytesContain(b []byte, s string) bool {
+	for i := 0; i+len(s) <= len(b); i++ {
+		if string(b[i:i+len(s)]) == s {
+			return true
+		}
+	}
+	return false
+}
@@ -29,31 +29,44 @@ func (sbf *StringBodyFilter) FilterRequest(request *Request) *http.Response {
 	// This caches the request body so that multiple filters can iterate it
 	if req.Method == "POST" || req.Method == "PUT" {
 		sb, err := sbf.readRequestBody(req)
+		if _, tooLarge := err.(*http.MaxBytesError); tooLarge {
+			request.CurrentStage.Status = StatusFail
+			return bodyTooLargeResponse(req)
+		}
 		if sb == nil || err != nil {
-			request.CurrentStage.Status = 3 // Skip
+			request.CurrentStage.Status = StatusBodySkipped
 			Debug("%s No Req Body or Ignored: %v", request.ID, err)
 		}
 	} else {
-		request.CurrentStage.Status = 1 // Skip
+		request.CurrentStage.Status = StatusSkip
 	}
 	return nil
 }
 
 // reads the request body and replaces the buffer with self
 // returns nil if the body is multipart and not replaced
+// bodies over 10 MB fail with *http.MaxBytesError
 func (sbf *StringBodyFilter) readRequestBody(r *http.Request) (sb *StringBody, err error) {
 	ct := r.Header.Get("Content-Type")
 	// leave it on the buffer if we're multipart
 	if strings.SplitN(ct, ";", 2)[0] != "multipart/form-data" && r.ContentLength > 0 {
-		sb = &StringBody{}
 		const maxFormSize = int64(10 << 20) // 10 MB is a lot of text.
+		if r.ContentLength > maxFormSize {
+			return nil, &http.MaxBytesError{Limit: maxFormSize}
+		}
+		sb = &StringBody{}
 		sb.bpe = sbf.pool.take(io.LimitReader(r.Body, maxFormSize+1))
 
 		// There shouldn't be a null byte so we should get EOF
 		b, e := sb.bpe.br.ReadBytes(0)
 		if e != nil && e != io.EOF {
+			sbf.pool.give(sb.bpe)
 			return nil, e
 		}
+		if int64(len(b)) > maxFormSize {
+			sbf.pool.give(sb.bpe)
+			return nil, &http.MaxBytesError{Limit: maxFormSize}
+		}
 		sb.BodyBuffer = bytes.NewReader(b)
 		r.Body.Close()
 		r.Body = sb
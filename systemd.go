@@ -0,0 +1,116 @@
+// +build !windows
+
+package falcore
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// systemd passes activated sockets starting at this fd (SD_LISTEN_FDS_START)
+const systemdListenFdsStart = 3
+
+// A socket passed in by systemd socket activation
+type activatedSocket struct {
+	fd   int
+	name string
+	used bool
+}
+
+var (
+	systemdOnce    sync.Once
+	systemdMutex   sync.Mutex
+	systemdSockets []*activatedSocket
+	systemdErr     error
+)
+
+// Adds listeners for the sockets passed in by systemd socket activation
+// (LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES).  Only sockets whose
+// FileDescriptorName matches one of names are used, so several Servers
+// in one process can each claim their own sockets.  With no names, every
+// socket not already claimed by another Server is used.
+//
+// Returns the number of listeners added.  Zero with no error means the
+// process wasn't socket activated and the Server should listen itself.
+func (srv *Server) SystemdListen(names ...string) (int, error) {
+	systemdOnce.Do(func() {
+		systemdSockets, systemdErr = systemdActivatedSockets()
+	})
+	if systemdErr != nil {
+		return 0, systemdErr
+	}
+
+	systemdMutex.Lock()
+	defer systemdMutex.Unlock()
+	count := 0
+	for _, sock := range systemdSockets {
+		if sock.used || !systemdNameMatches(sock.name, names) {
+			continue
+		}
+		if err := srv.FdListen(sock.fd); err != nil {
+			return count, fmt.Errorf("systemd socket %v (%v): %v", sock.fd, sock.name, err)
+		}
+		sock.used = true
+		count++
+	}
+	return count, nil
+}
+
+func systemdNameMatches(name string, names []string) bool {
+	if len(names) == 0 {
+		return true
+	}
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Reads the sockets from the environment and unsets it so that
+// child processes don't think the sockets are theirs.
+func systemdActivatedSockets() ([]*activatedSocket, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	socks, err := parseSystemdEnv(os.Getpid(), os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES"))
+	for _, sock := range socks {
+		syscall.CloseOnExec(sock.fd)
+	}
+	return socks, err
+}
+
+func parseSystemdEnv(pid int, listenPid, listenFds, listenFdNames string) ([]*activatedSocket, error) {
+	if listenPid == "" || listenFds == "" {
+		return nil, nil
+	}
+	if p, err := strconv.Atoi(listenPid); err != nil {
+		return nil, fmt.Errorf("Bad LISTEN_PID %q: %v", listenPid, err)
+	} else if p != pid {
+		// meant for some other process
+		return nil, nil
+	}
+	count, err := strconv.Atoi(listenFds)
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("Bad LISTEN_FDS %q", listenFds)
+	}
+	var names []string
+	if listenFdNames != "" {
+		names = strings.Split(listenFdNames, ":")
+	}
+	socks := make([]*activatedSocket, count)
+	for i := range socks {
+		socks[i] = &activatedSocket{fd: systemdListenFdsStart + i, name: "unknown"}
+		if i < len(names) {
+			socks[i].name = names[i]
+		}
+	}
+	return socks, nil
+}
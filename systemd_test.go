@@ -0,0 +1,113 @@
+// +build !windows
+
+package falcore
+
+import (
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+var systemdEnvTests = []struct {
+	name     string
+	pid      string
+	fds      string
+	fdNames  string
+	expected []string
+	err      bool
+}{
+	{"not activated", "", "", "", nil, false},
+	{"other process", "1", "2", "", nil, false},
+	{"unnamed", "100", "2", "", []string{"unknown", "unknown"}, false},
+	{"named", "100", "2", "http:admin", []string{"http", "admin"}, false},
+	{"bad count", "100", "two", "", nil, true},
+}
+
+func TestParseSystemdEnv(t *testing.T) {
+	for _, test := range systemdEnvTests {
+		socks, err := parseSystemdEnv(100, test.pid, test.fds, test.fdNames)
+		if (err != nil) != test.err {
+			t.Errorf("%v: Unexpected error: %v", test.name, err)
+		}
+		if len(socks) != len(test.expected) {
+			t.Errorf("%v: Expected %d sockets, got %d", test.name, len(test.expected), len(socks))
+			continue
+		}
+		for i, sock := range socks {
+			if sock.fd != systemdListenFdsStart+i || sock.name != test.expected[i] {
+				t.Errorf("%v: Socket %d mismatch: %v %v", test.name, i, sock.fd, sock.name)
+			}
+		}
+	}
+}
+
+func TestSystemdListen(t *testing.T) {
+	// nothing should come from the real environment
+	for _, name := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		t.Setenv(name, "")
+	}
+	savedSockets, savedErr := systemdSockets, systemdErr
+	fresh := false
+	systemdOnce.Do(func() { fresh = true })
+	defer func() {
+		if fresh {
+			systemdOnce = sync.Once{}
+		}
+		systemdSockets, systemdErr = savedSockets, savedErr
+	}()
+
+	// pretend these were passed in by systemd
+	systemdSockets, systemdErr = nil, nil
+	for _, name := range []string{"http", "admin"} {
+		l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatalf("Could not listen: %v", err)
+		}
+		defer l.Close()
+		// the Server owns the fd it's given so it gets its own copy
+		fd, err := dupListenerFd(l)
+		if err != nil {
+			t.Fatalf("Could not dup the listener: %v", err)
+		}
+		systemdSockets = append(systemdSockets, &activatedSocket{fd: fd, name: name})
+	}
+
+	pipeline := NewPipeline()
+	pipeline.Upstream.PushBack(NewRequestFilter(helloFilter))
+	admin := NewServer(0, pipeline)
+	t.Cleanup(func() { closeClaimedListeners(admin) })
+	if n, err := admin.SystemdListen("admin"); n != 1 || err != nil {
+		t.Fatalf("Expected the admin socket: %v %v", n, err)
+	}
+	srv := NewServer(0, pipeline)
+	t.Cleanup(func() { closeClaimedListeners(srv) })
+	if n, err := srv.SystemdListen(); n != 1 || err != nil {
+		t.Fatalf("Expected the unclaimed socket: %v %v", n, err)
+	}
+	startTestServer(srv)
+
+	c, br := dialTestServer(t, srv)
+	defer c.Close()
+	if _, body := roundTrip(t, c, br, "GET / HTTP/1.1\r\nHost: test\r\n\r\n"); body != "hello" {
+		t.Errorf("Body mismatch: %q", body)
+	}
+}
+
+// Closes the listeners a server took from systemd along with the fds
+// they were made from
+func closeClaimedListeners(srv *Server) {
+	srv.StopAccepting()
+	for _, f := range srv.listenerFiles {
+		f.Close()
+	}
+}
+
+func dupListenerFd(l *net.TCPListener) (int, error) {
+	f, err := l.File()
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return syscall.Dup(int(f.Fd()))
+}
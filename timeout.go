@@ -0,0 +1,43 @@
+package falcore
+
+import (
+	"io"
+	"net"
+)
+
+// Wraps the request body so that a ReadTimeout expiring while a stage
+// is reading the body gets recorded against that stage.
+type timeoutReader struct {
+	req      *Request
+	r        io.ReadCloser
+	timedOut bool
+}
+
+var _ io.ReadCloser = new(timeoutReader)
+
+func (r *timeoutReader) Read(p []byte) (n int, err error) {
+	n, err = r.r.Read(p)
+	r.check(err)
+	return
+}
+
+func (r *timeoutReader) Close() error {
+	// closing drains whatever the pipeline didn't read
+	err := r.r.Close()
+	r.check(err)
+	return err
+}
+
+func (r *timeoutReader) check(err error) {
+	if err != nil && isTimeout(err) {
+		r.timedOut = true
+		if r.req.CurrentStage != nil {
+			r.req.CurrentStage.Status = StatusTimeout
+		}
+	}
+}
+
+func isTimeout(err error) bool {
+	nerr, ok := err.(net.Error)
+	return ok && nerr.Timeout()
+}
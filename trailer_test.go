@@ -0,0 +1,83 @@
+package falcore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func trailerFilter(req *Request) *http.Response {
+	switch req.HttpRequest.URL.Path {
+	case "/stream":
+		res := StreamResponse(req.HttpRequest, 200, nil, func(w *StreamWriter) error {
+			w.Write([]byte("streamed"))
+			w.Trailer().Set("X-Checksum", "abc")
+			return nil
+		})
+		res.Trailer = http.Header{"X-Checksum": nil}
+		return res
+	case "/echo":
+		// trailers show up once the body has been read
+		body, _ := ioutil.ReadAll(req.HttpRequest.Body)
+		return SimpleResponse(req.HttpRequest, 200, nil, string(body)+" "+req.HttpRequest.Trailer.Get("X-Checksum"))
+	}
+	res := SimpleResponse(req.HttpRequest, 200, nil, "hello")
+	res.Trailer = http.Header{"X-Checksum": {"def"}}
+	return res
+}
+
+func TestServerResponseTrailer(t *testing.T) {
+	srv := newTestServer(t, trailerFilter)
+	startTestServer(srv)
+	defer srv.Shutdown(time.Now().Add(time.Second))
+
+	c, br := dialTestServer(t, srv)
+	defer c.Close()
+	// a body with a Content-Length is sent chunked to make room for them
+	res, body := roundTrip(t, c, br, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+	if body != "hello" || res.Trailer.Get("X-Checksum") != "def" {
+		t.Errorf("Expected the trailer got %q %v", body, res.Trailer)
+	}
+	res, body = roundTrip(t, c, br, "GET /stream HTTP/1.1\r\nHost: test\r\n\r\n")
+	if body != "streamed" || res.Trailer.Get("X-Checksum") != "abc" {
+		t.Errorf("Expected the stream's trailer got %q %v", body, res.Trailer)
+	}
+	// HTTP/1.0 doesn't get them
+	res, body = roundTrip(t, c, br, "GET / HTTP/1.0\r\n\r\n")
+	if body != "hello" || res.ContentLength != 5 || len(res.Trailer) != 0 {
+		t.Errorf("Expected a plain response got %q %v %v", body, res.ContentLength, res.Trailer)
+	}
+}
+
+func TestServerRequestTrailer(t *testing.T) {
+	srv := newTestServer(t, trailerFilter)
+	startTestServer(srv)
+	defer srv.Shutdown(time.Now().Add(time.Second))
+
+	c, br := dialTestServer(t, srv)
+	defer c.Close()
+	_, body := roundTrip(t, c, br, "POST /echo HTTP/1.1\r\nHost: test\r\nTransfer-Encoding: chunked\r\nTrailer: X-Checksum\r\n\r\n"+
+		"5\r\nhello\r\n0\r\nX-Checksum: xyz\r\n\r\n")
+	if body != "hello xyz" {
+		t.Errorf("Expected the request trailer got %q", body)
+	}
+}
+
+func TestServerHTTP2Trailer(t *testing.T) {
+	srv := newTestServer(t, trailerFilter)
+	srv.H2C = true
+	startTestServer(srv)
+	defer srv.Shutdown(time.Now().Add(time.Second))
+
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: transport}
+	for path, want := range map[string]string{"/": "def", "/stream": "abc"} {
+		res, _ := http2Get(t, client, fmt.Sprintf("http://localhost:%v%v", srv.Port(), path))
+		if res.ProtoMajor != 2 || res.Trailer.Get("X-Checksum") != want {
+			t.Errorf("%v: Expected the trailer over %v got %v", path, res.Proto, res.Trailer)
+		}
+	}
+}
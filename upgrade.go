@@ -0,0 +1,93 @@
+package falcore
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Takes over a connection after a 101 Switching Protocols response has
+// been written.  rw reads anything the client sent after the request and
+// writes to the connection.  The connection is closed when the handler
+// returns.
+//
+// The Server still tracks the connection.  Shutdown waits for the
+// handler to return and closes the connection at the deadline.
+type UpgradeHandler func(req *Request, conn net.Conn, rw *bufio.ReadWriter)
+
+// Returns a 101 Switching Protocols response to protocol.  Once it's
+// written the Server stops HTTP processing on the connection and hands it
+// to handler.  Any headers set on the response by downstream filters are
+// sent.
+//
+// Upgrades aren't possible over HTTP/2.  Those clients get a 400.
+func UpgradeResponse(req *http.Request, protocol string, handler UpgradeHandler) *http.Response {
+	res := new(http.Response)
+	res.StatusCode = 101
+	res.ProtoMajor = 1
+	res.ProtoMinor = 1
+	res.Request = req
+	res.Header = make(http.Header)
+	res.Header.Set("Connection", "Upgrade")
+	res.Header.Set("Upgrade", protocol)
+	res.Body = &upgradeBody{handler: handler}
+	return res
+}
+
+// An empty body that carries the UpgradeHandler through the pipeline
+type upgradeBody struct {
+	handler UpgradeHandler
+}
+
+func (b *upgradeBody) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (b *upgradeBody) Close() error {
+	return nil
+}
+
+// The handler if res switches protocols
+func upgradeHandler(res *http.Response) UpgradeHandler {
+	if ub, ok := res.Body.(*upgradeBody); ok && res.StatusCode == 101 {
+		return ub.handler
+	}
+	return nil
+}
+
+// Writes just the status line and headers.  There's no body to delimit.
+func writeUpgradeResponse(w *bufio.Writer, res *http.Response) error {
+	res.Body = nil
+	res.ContentLength = 0
+	res.TransferEncoding = nil
+	res.Close = false
+	res.Header.Del("Content-Length")
+	if err := res.Write(w); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// Writes the 101 and runs the handler on the connection
+func (srv *Server) upgradeConn(c net.Conn, br *bufio.Reader, request *Request, res *http.Response, handler UpgradeHandler) {
+	// the new protocol won't write whole responses at once
+	srv.uncork(c)
+	w := bufio.NewWriter(c)
+	err := writeUpgradeResponse(w, res)
+	if err != nil && isTimeout(err) {
+		request.CurrentStage.Status = StatusTimeout
+	}
+	request.finishPipelineStage()
+	request.finishRequest()
+	srv.requestFinished(request)
+	if err != nil {
+		return
+	}
+
+	// the handler's in charge of timeouts now
+	c.SetDeadline(time.Time{})
+	srv.setConnState(c, ConnHijacked)
+	handler(request, c, bufio.NewReadWriter(br, w))
+}
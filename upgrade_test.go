@@ -0,0 +1,83 @@
+package falcore
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Upgrades to a line echo protocol
+func echoUpgradeFilter(req *Request) *http.Response {
+	if req.HttpRequest.URL.Path != "/echo" {
+		return SimpleResponse(req.HttpRequest, 200, nil, "hello")
+	}
+	return UpgradeResponse(req.HttpRequest, "echo", func(req *Request, c net.Conn, rw *bufio.ReadWriter) {
+		for {
+			line, err := rw.ReadString('\n')
+			if err != nil {
+				return
+			}
+			rw.WriteString(line)
+			rw.Flush()
+		}
+	})
+}
+
+func TestServerUpgrade(t *testing.T) {
+	srv := newTestServer(t, echoUpgradeFilter)
+	startTestServer(srv)
+
+	c, br := dialTestServer(t, srv)
+	defer c.Close()
+	// the first line arrives along with the request and is already buffered
+	io.WriteString(c, "GET /echo HTTP/1.1\r\nHost: test\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\nfirst\n")
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	res, err := http.ReadResponse(br, nil)
+	if err != nil || res.StatusCode != 101 || res.Header.Get("Upgrade") != "echo" {
+		t.Fatalf("Expected 101 Switching Protocols: %v %v", res, err)
+	}
+	if res.Header.Get("Content-Length") != "" || len(res.TransferEncoding) > 0 {
+		t.Errorf("101 shouldn't have a body: %v", res.Header)
+	}
+	if line, _ := br.ReadString('\n'); line != "first\n" {
+		t.Errorf("Expected the buffered line: %q", line)
+	}
+	io.WriteString(c, "second\n")
+	if line, _ := br.ReadString('\n'); line != "second\n" {
+		t.Errorf("Expected the echo: %q", line)
+	}
+
+	// upgraded connections are active until the handler returns
+	if active, idle := srv.Connections(); active != 1 || idle != 0 {
+		t.Errorf("Expected 1 active connection got %v active %v idle", active, idle)
+	}
+	status := srv.Shutdown(time.Now().Add(100 * time.Millisecond))
+	if status.Killed != 1 {
+		t.Errorf("Expected the upgraded connection to be killed at the deadline: %+v", status)
+	}
+	if !connClosed(c, br) {
+		t.Errorf("Expected the upgraded connection to be closed")
+	}
+}
+
+func TestServerUpgradeHTTP2(t *testing.T) {
+	srv := newTestServer(t, echoUpgradeFilter)
+	srv.H2C = true
+	startTestServer(srv)
+	defer srv.Shutdown(time.Now().Add(time.Second))
+
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	res, err := (&http.Client{Transport: transport}).Get(fmt.Sprintf("http://localhost:%v/echo", srv.Port()))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 400 {
+		t.Errorf("Expected upgrades over HTTP/2 to be refused: %v", res.StatusCode)
+	}
+}
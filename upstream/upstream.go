@@ -147,15 +147,31 @@ func (u *Upstream) FilterRequest(request *falcore.Request) (res *http.Response)
 				res.Header[hn] = hv
 			}
 		}
+		// filled in once the body has been read.  the server sends them
+		// after the last chunk.
+		res.Trailer = upstrRes.Trailer
 	} else {
-		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		// the request's context aborts the round trip when the client goes
+		// away, the server is killed or the request takes too long
+		if cerr := request.Err(); cerr != nil {
+			falcore.Debug("%s Upstream request cancelled: %v", request.ID, cerr)
+			// not the upstream's fault so don't fail the stage.  the pool
+			// would take the upstream out of rotation.
+			request.CurrentStage.Status = falcore.StatusSkip
+			request.CurrentStage.Err = cerr
+			if cerr == falcore.ErrRequestTimeout {
+				res = falcore.SimpleResponse(req, 504, nil, "Gateway Timeout\n")
+			} else {
+				res = falcore.SimpleResponse(req, 503, nil, "Service Unavailable\n")
+			}
+		} else if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
 			falcore.Error("%s Upstream Timeout error: %v", request.ID, err)
 			res = falcore.SimpleResponse(req, 504, nil, "Gateway Timeout\n")
-			request.CurrentStage.Status = 2 // Fail
+			request.Fail(err)
 		} else {
 			falcore.Error("%s Upstream error: %v", request.ID, err)
 			res = falcore.SimpleResponse(req, 502, nil, "Bad Gateway\n")
-			request.CurrentStage.Status = 2 // Fail
+			request.Fail(err)
 		}
 	}
 	falcore.Debug("%s [%s] [%s] %s s=%d Time=%.4f", request.ID, req.Method, u.host, req.URL, res.StatusCode, diff)
@@ -93,7 +93,7 @@ func (up UpstreamPool) LogStatus() {
 func (up UpstreamPool) FilterRequest(req *falcore.Request) (res *http.Response) {
 	ue := up.Next()
 	res = ue.Upstream.FilterRequest(req)
-	if req.CurrentStage.Status == 2 {
+	if req.CurrentStage.Status == falcore.StatusFail {
 		// this gets set by the upstream for errors
 		// so mark this upstream as down
 		up.updateUpstream(ue, 0)
@@ -0,0 +1,67 @@
+package upstream
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ngmoco/falcore"
+)
+
+// A backend that doesn't answer until the request is cancelled
+func newStuckBackend() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+}
+
+func poolWeight(up *UpstreamPool) int {
+	up.weightMutex.RLock()
+	defer up.weightMutex.RUnlock()
+	return up.pool[0].Weight
+}
+
+func TestUpstreamPoolClientDisconnect(t *testing.T) {
+	backend := newStuckBackend()
+	defer backend.Close()
+	up := NewUpstreamPool("test", []UpstreamEntryConfig{{HostPort: strings.TrimPrefix(backend.URL, "http://"), Weight: 1}})
+	// Shutdown can deadlock once nextServer has seen the shutdown so
+	// the goroutines are just stopped
+	defer close(up.shutdown)
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	time.AfterFunc(100*time.Millisecond, func() {
+		cancel(falcore.ErrClientDisconnected)
+	})
+	tmp, _ := http.NewRequestWithContext(ctx, "GET", backend.URL+"/", nil)
+	req, res := falcore.TestWithRequest(tmp, up, nil)
+	if res.StatusCode != 503 {
+		t.Errorf("Expected 503 got %v", res.StatusCode)
+	}
+	if req.CurrentStage.Status != falcore.StatusSkip || req.CurrentStage.Err != falcore.ErrClientDisconnected {
+		t.Errorf("Expected the cancellation on a skipped stage got %v %v", req.CurrentStage.Status, req.CurrentStage.Err)
+	}
+	if wgt := poolWeight(up); wgt != 1 {
+		t.Errorf("Expected the upstream to stay in rotation, weight %v", wgt)
+	}
+}
+
+func TestUpstreamPoolBackendDown(t *testing.T) {
+	backend := newStuckBackend()
+	hostPort := strings.TrimPrefix(backend.URL, "http://")
+	backend.Close()
+	up := NewUpstreamPool("test", []UpstreamEntryConfig{{HostPort: hostPort, Weight: 1}})
+	defer close(up.shutdown)
+
+	tmp, _ := http.NewRequest("GET", "http://"+hostPort+"/", nil)
+	req, res := falcore.TestWithRequest(tmp, up, nil)
+	if res.StatusCode != 502 || req.CurrentStage.Status != falcore.StatusFail {
+		t.Errorf("Expected a failed 502 got %v %v", res.StatusCode, req.CurrentStage.Status)
+	}
+	if wgt := poolWeight(up); wgt != 0 {
+		t.Errorf("Expected the upstream to be taken out of rotation, weight %v", wgt)
+	}
+}
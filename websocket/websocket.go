@@ -0,0 +1,373 @@
+// RFC 6455 WebSockets on falcore connection upgrades.
+//
+//	ws := websocket.NewFilter(func(conn *websocket.Conn) {
+//	    for {
+//	        t, msg, err := conn.ReadMessage()
+//	        if err != nil {
+//	            return
+//	        }
+//	        conn.WriteMessage(t, msg)
+//	    }
+//	})
+//	pipeline.Upstream.PushBack(ws)
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/ngmoco/falcore"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Message and frame opcodes
+const (
+	ContinuationMessage = 0x0
+	TextMessage         = 0x1
+	BinaryMessage       = 0x2
+	CloseMessage        = 0x8
+	PingMessage         = 0x9
+	PongMessage         = 0xA
+)
+
+// Close codes.  See RFC 6455 section 7.4.1.
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	CloseNoStatus        = 1005
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+)
+
+// Default for Filter.MaxMessageSize
+const DefaultMaxMessageSize = 1 << 20
+
+// Returned by ReadMessage once the connection is closed
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket closed %v %v", e.Code, e.Reason)
+}
+
+var (
+	errProtocol = &CloseError{Code: CloseProtocolError, Reason: "protocol error"}
+	errClosed   = errors.New("websocket: connection closed")
+)
+
+// Upgrades WebSocket handshake requests and passes the connection to
+// Handler.  Other requests pass through to the next filter.
+type Filter struct {
+	Handler func(conn *Conn)
+	// Subprotocols the server speaks in order of preference.  The first
+	// one the client also offers is chosen.
+	Subprotocols []string
+	// Decides whether to accept the handshake from the request's Origin.
+	// Nil accepts everything.  Rejected handshakes get a 403.
+	CheckOrigin func(req *falcore.Request) bool
+	// The largest message ReadMessage will return.  Bigger ones close the
+	// connection with CloseMessageTooBig.  Zero uses
+	// DefaultMaxMessageSize.
+	MaxMessageSize int64
+}
+
+func NewFilter(handler func(conn *Conn)) *Filter {
+	f := new(Filter)
+	f.Handler = handler
+	f.MaxMessageSize = DefaultMaxMessageSize
+	return f
+}
+
+func (f *Filter) FilterRequest(request *falcore.Request) *http.Response {
+	req := request.HttpRequest
+	if !headerHasToken(req.Header, "Connection", "upgrade") || !headerHasToken(req.Header, "Upgrade", "websocket") {
+		request.CurrentStage.Status = falcore.StatusSkip
+		return nil
+	}
+	if req.Method != "GET" {
+		return falcore.SimpleResponse(req, 405, nil, "WebSocket handshakes must be GET\n")
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		header := make(http.Header)
+		header.Set("Sec-WebSocket-Version", "13")
+		return falcore.SimpleResponse(req, 426, header, "Unsupported WebSocket version\n")
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return falcore.SimpleResponse(req, 400, nil, "Bad Sec-WebSocket-Key\n")
+	}
+	if f.CheckOrigin != nil && !f.CheckOrigin(request) {
+		return falcore.SimpleResponse(req, 403, nil, "Origin not allowed\n")
+	}
+
+	subprotocol := f.chooseSubprotocol(req)
+	res := falcore.UpgradeResponse(req, "websocket", func(request *falcore.Request, c net.Conn, rw *bufio.ReadWriter) {
+		conn := &Conn{
+			Request:        request,
+			Subprotocol:    subprotocol,
+			MaxMessageSize: f.MaxMessageSize,
+			conn:           c,
+			rw:             rw,
+		}
+		f.Handler(conn)
+		conn.Close(CloseNormal, "")
+	})
+	res.Header.Set("Sec-WebSocket-Accept", acceptKey(key))
+	if subprotocol != "" {
+		res.Header.Set("Sec-WebSocket-Protocol", subprotocol)
+	}
+	return res
+}
+
+func (f *Filter) chooseSubprotocol(req *http.Request) string {
+	for _, p := range f.Subprotocols {
+		if headerHasToken(req.Header, "Sec-WebSocket-Protocol", p) {
+			return p
+		}
+	}
+	return ""
+}
+
+func acceptKey(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key+acceptGUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Whether a comma separated header contains token, ignoring case
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, v := range header[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// A WebSocket connection.  One goroutine may read while another writes.
+type Conn struct {
+	// The handshake request
+	Request *falcore.Request
+	// The negotiated subprotocol or empty
+	Subprotocol string
+	// Like Filter.MaxMessageSize
+	MaxMessageSize int64
+
+	conn       net.Conn
+	rw         *bufio.ReadWriter
+	writeMutex sync.Mutex
+	closeSent  bool
+}
+
+// The underlying connection.  Useful for setting deadlines.
+func (c *Conn) NetConn() net.Conn {
+	return c.conn
+}
+
+// Reads the next text or binary message, reassembling fragments.  Pings
+// are answered and pongs are ignored.  When the client closes the
+// connection the close is echoed and a *CloseError is returned.
+func (c *Conn) ReadMessage() (messageType int, data []byte, err error) {
+	messageType = -1
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return -1, nil, c.fail(err)
+		}
+		switch opcode {
+		case PingMessage:
+			if err := c.writeFrame(PongMessage, payload); err != nil {
+				return -1, nil, err
+			}
+			continue
+		case PongMessage:
+			continue
+		case CloseMessage:
+			return -1, nil, c.closeReceived(payload)
+		case TextMessage, BinaryMessage:
+			if messageType != -1 {
+				// a new message before the last one finished
+				return -1, nil, c.fail(errProtocol)
+			}
+			messageType = opcode
+		case ContinuationMessage:
+			if messageType == -1 {
+				return -1, nil, c.fail(errProtocol)
+			}
+		default:
+			return -1, nil, c.fail(errProtocol)
+		}
+
+		if int64(len(data)+len(payload)) > c.maxMessageSize() {
+			return -1, nil, c.fail(&CloseError{Code: CloseMessageTooBig, Reason: "message too big"})
+		}
+		data = append(data, payload...)
+		if fin {
+			if messageType == TextMessage && !utf8.Valid(data) {
+				return -1, nil, c.fail(&CloseError{Code: CloseInvalidPayload, Reason: "invalid UTF-8"})
+			}
+			return messageType, data, nil
+		}
+	}
+}
+
+// Writes a whole message in one frame.  Ping and pong payloads can't be
+// over 125 bytes.
+func (c *Conn) WriteMessage(messageType int, data []byte) error {
+	switch messageType {
+	case TextMessage, BinaryMessage:
+	case PingMessage, PongMessage:
+		if len(data) > 125 {
+			return errors.New("websocket: control frame payload too long")
+		}
+	default:
+		return errors.New("websocket: bad message type")
+	}
+	return c.writeFrame(messageType, data)
+}
+
+// Sends a close frame and closes the connection
+func (c *Conn) Close(code int, reason string) error {
+	c.sendClose(code, reason)
+	return c.conn.Close()
+}
+
+func (c *Conn) sendClose(code int, reason string) error {
+	var payload []byte
+	if code != CloseNoStatus {
+		payload = make([]byte, 2, 2+len(reason))
+		binary.BigEndian.PutUint16(payload, uint16(code))
+		payload = append(payload, reason...)
+	}
+	return c.writeFrame(CloseMessage, payload)
+}
+
+// Echoes the client's close and returns its code
+func (c *Conn) closeReceived(payload []byte) error {
+	ce := &CloseError{Code: CloseNoStatus}
+	if len(payload) == 1 {
+		return c.fail(errProtocol)
+	} else if len(payload) >= 2 {
+		ce.Code = int(binary.BigEndian.Uint16(payload))
+		ce.Reason = string(payload[2:])
+		if !utf8.ValidString(ce.Reason) {
+			return c.fail(&CloseError{Code: CloseInvalidPayload, Reason: "invalid UTF-8"})
+		}
+	}
+	c.sendClose(ce.Code, "")
+	c.conn.Close()
+	return ce
+}
+
+// Closes the connection with the code for a protocol violation
+func (c *Conn) fail(err error) error {
+	if ce, ok := err.(*CloseError); ok {
+		c.sendClose(ce.Code, ce.Reason)
+	}
+	c.conn.Close()
+	return err
+}
+
+// Frames are checked against this before their payload is allocated so
+// there's always a limit
+func (c *Conn) maxMessageSize() int64 {
+	if c.MaxMessageSize > 0 {
+		return c.MaxMessageSize
+	}
+	return DefaultMaxMessageSize
+}
+
+func (c *Conn) readFrame() (fin bool, opcode int, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(c.rw, head[:]); err != nil {
+		return
+	}
+	fin = head[0]&0x80 != 0
+	opcode = int(head[0] & 0xF)
+	if head[0]&0x70 != 0 {
+		// no extensions are negotiated so the RSV bits must be clear
+		return false, 0, nil, errProtocol
+	}
+	if head[1]&0x80 == 0 {
+		// clients must mask
+		return false, 0, nil, errProtocol
+	}
+
+	length := uint64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.rw, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.rw, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if opcode >= CloseMessage && (length > 125 || !fin) {
+		// control frames are short and never fragmented
+		return false, 0, nil, errProtocol
+	}
+	if length > uint64(c.maxMessageSize()) {
+		return false, 0, nil, &CloseError{Code: CloseMessageTooBig, Reason: "message too big"}
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(c.rw, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.rw, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+// Server frames are never masked.  Nothing can be written after a close.
+func (c *Conn) writeFrame(opcode int, payload []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if c.closeSent {
+		return errClosed
+	}
+	c.closeSent = opcode == CloseMessage
+	w := c.rw.Writer
+	w.WriteByte(0x80 | byte(opcode))
+	switch l := len(payload); {
+	case l <= 125:
+		w.WriteByte(byte(l))
+	case l <= 0xFFFF:
+		w.WriteByte(126)
+		binary.Write(w, binary.BigEndian, uint16(l))
+	default:
+		w.WriteByte(127)
+		binary.Write(w, binary.BigEndian, uint64(l))
+	}
+	w.Write(payload)
+	return w.Flush()
+}
@@ -0,0 +1,216 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/ngmoco/falcore"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+const testKey = "dGhlIHNhbXBsZSBub25jZQ=="
+
+func startEchoServer(t *testing.T, f *Filter) *falcore.Server {
+	pipeline := falcore.NewPipeline()
+	pipeline.Upstream.PushBack(f)
+	srv := falcore.NewServer(0, pipeline)
+	if err := srv.Listen("tcp", "localhost:0"); err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	go srv.ListenAndServe()
+	<-srv.AcceptReady
+	return srv
+}
+
+func newEchoFilter() *Filter {
+	return NewFilter(func(conn *Conn) {
+		for {
+			t, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(t, msg)
+		}
+	})
+}
+
+// Sends the handshake and returns the response
+func dialWebSocket(t *testing.T, srv *falcore.Server, headers string) (net.Conn, *bufio.Reader, *http.Response) {
+	c, err := net.Dial("tcp", fmt.Sprintf("localhost:%v", srv.Port()))
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(c, "GET /ws HTTP/1.1\r\nHost: test\r\n"+headers+"\r\n")
+	br := bufio.NewReader(c)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	return c, br, res
+}
+
+const upgradeHeaders = "Connection: keep-alive, Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: " + testKey + "\r\n"
+
+// Clients mask every frame
+func writeClientFrame(c net.Conn, fin bool, opcode byte, payload []byte) {
+	head := []byte{opcode, 0x80}
+	if fin {
+		head[0] |= 0x80
+	}
+	if len(payload) < 126 {
+		head[1] |= byte(len(payload))
+	} else {
+		head[1] |= 126
+		head = append(head, 0, 0)
+		binary.BigEndian.PutUint16(head[2:], uint16(len(payload)))
+	}
+	mask := []byte{1, 2, 3, 4}
+	masked := make([]byte, len(payload))
+	for i := range payload {
+		masked[i] = payload[i] ^ mask[i%4]
+	}
+	c.Write(append(append(head, mask...), masked...))
+}
+
+func readServerFrame(t *testing.T, br *bufio.Reader) (byte, []byte) {
+	var head [2]byte
+	if _, err := io.ReadFull(br, head[:]); err != nil {
+		t.Fatalf("Reading frame failed: %v", err)
+	}
+	if head[1]&0x80 != 0 {
+		t.Errorf("Server frames must not be masked")
+	}
+	length := int(head[1] & 0x7F)
+	if length == 126 {
+		var ext [2]byte
+		io.ReadFull(br, ext[:])
+		length = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	payload := make([]byte, length)
+	io.ReadFull(br, payload)
+	return head[0] & 0xF, payload
+}
+
+func TestAcceptKey(t *testing.T) {
+	// from RFC 6455 section 1.3
+	if key := acceptKey(testKey); key != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Bad accept key %v", key)
+	}
+}
+
+func TestEcho(t *testing.T) {
+	srv := startEchoServer(t, newEchoFilter())
+	defer srv.StopAccepting()
+
+	c, br, res := dialWebSocket(t, srv, upgradeHeaders)
+	defer c.Close()
+	if res.StatusCode != 101 || res.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Bad handshake response: %v %v", res.StatusCode, res.Header)
+	}
+
+	writeClientFrame(c, true, TextMessage, []byte("hello"))
+	if op, msg := readServerFrame(t, br); op != TextMessage || string(msg) != "hello" {
+		t.Errorf("Expected text echo got %v %q", op, msg)
+	}
+
+	// fragmented message with a ping in the middle
+	writeClientFrame(c, false, BinaryMessage, []byte("frag"))
+	writeClientFrame(c, true, PingMessage, []byte("p"))
+	writeClientFrame(c, true, ContinuationMessage, make([]byte, 200))
+	if op, msg := readServerFrame(t, br); op != PongMessage || string(msg) != "p" {
+		t.Errorf("Expected pong got %v %q", op, msg)
+	}
+	if op, msg := readServerFrame(t, br); op != BinaryMessage || len(msg) != 204 {
+		t.Errorf("Expected the reassembled message got %v %v bytes", op, len(msg))
+	}
+
+	// closing handshake
+	writeClientFrame(c, true, CloseMessage, []byte{0x03, 0xE8})
+	if op, msg := readServerFrame(t, br); op != CloseMessage || binary.BigEndian.Uint16(msg) != CloseNormal {
+		t.Errorf("Expected the close to be echoed got %v %v", op, msg)
+	}
+}
+
+func TestProtocolErrors(t *testing.T) {
+	srv := startEchoServer(t, newEchoFilter())
+	defer srv.StopAccepting()
+
+	tests := []struct {
+		name string
+		send func(c net.Conn)
+		code uint16
+	}{
+		{"unmasked", func(c net.Conn) { c.Write([]byte{0x81, 0x01, 'x'}) }, CloseProtocolError},
+		{"bad utf8", func(c net.Conn) { writeClientFrame(c, true, TextMessage, []byte{0xff, 0xfe}) }, CloseInvalidPayload},
+		{"stray continuation", func(c net.Conn) { writeClientFrame(c, true, ContinuationMessage, []byte("x")) }, CloseProtocolError},
+	}
+	for _, test := range tests {
+		c, br, _ := dialWebSocket(t, srv, upgradeHeaders)
+		test.send(c)
+		if op, msg := readServerFrame(t, br); op != CloseMessage || len(msg) < 2 || binary.BigEndian.Uint16(msg) != test.code {
+			t.Errorf("%v: expected close %v got %v %v", test.name, test.code, op, msg)
+		}
+		c.Close()
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	f := newEchoFilter()
+	f.MaxMessageSize = 0
+	srv := startEchoServer(t, f)
+	defer srv.StopAccepting()
+
+	c, br, _ := dialWebSocket(t, srv, upgradeHeaders)
+	defer c.Close()
+	// a 1TB frame is refused before anything is allocated for it
+	head := []byte{0x82, 0x80 | 127, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint64(head[2:], 1<<40)
+	c.Write(head)
+	if op, msg := readServerFrame(t, br); op != CloseMessage || len(msg) < 2 || binary.BigEndian.Uint16(msg) != CloseMessageTooBig {
+		t.Errorf("Expected close %v got %v %v", CloseMessageTooBig, op, msg)
+	}
+}
+
+func TestWriteControlTooLong(t *testing.T) {
+	c := new(Conn)
+	for _, op := range []int{PingMessage, PongMessage} {
+		if err := c.WriteMessage(op, make([]byte, 126)); err == nil {
+			t.Errorf("Expected an error for a 126 byte payload on %v", op)
+		}
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	f := newEchoFilter()
+	f.Subprotocols = []string{"chat.v2", "chat.v1"}
+	f.CheckOrigin = func(req *falcore.Request) bool {
+		return req.HttpRequest.Header.Get("Origin") != "http://evil.example.com"
+	}
+	srv := startEchoServer(t, f)
+	defer srv.StopAccepting()
+
+	tests := []struct {
+		name        string
+		headers     string
+		status      int
+		subprotocol string
+	}{
+		{"subprotocol", upgradeHeaders + "Sec-WebSocket-Protocol: chat.v1, chat.v2\r\n", 101, "chat.v2"},
+		{"bad version", "Connection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 8\r\nSec-WebSocket-Key: " + testKey + "\r\n", 426, ""},
+		{"bad key", "Connection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: short\r\n", 400, ""},
+		{"bad origin", upgradeHeaders + "Origin: http://evil.example.com\r\n", 403, ""},
+		{"not websocket", "", 404, ""},
+	}
+	for _, test := range tests {
+		c, _, res := dialWebSocket(t, srv, test.headers)
+		if res.StatusCode != test.status || res.Header.Get("Sec-WebSocket-Protocol") != test.subprotocol {
+			t.Errorf("%v: expected %v %q got %v %q", test.name, test.status, test.subprotocol, res.StatusCode, res.Header.Get("Sec-WebSocket-Protocol"))
+		}
+		c.Close()
+	}
+}